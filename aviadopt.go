@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	AVI_ADOPT_LABEL          = "avi_adopt"
+	AVI_ADOPT_SNAPSHOT_LABEL = "avi_adopt_snapshot"
+
+	// VS label marking an adopted VS on the controller, its value being
+	// the VS's original created_by
+	AVI_ADOPTED_LABEL = "avi_adopted"
+)
+
+// collisions records the VSes left untouched in the last cycle because
+// they clash with another owner.
+type collisions struct {
+	sync.Mutex
+	errs map[string]string
+}
+
+func NewCollisions() *collisions {
+	return &collisions{errs: make(map[string]string)}
+}
+
+func (c *collisions) Reset() {
+	c.Lock()
+	defer c.Unlock()
+	c.errs = make(map[string]string)
+}
+
+func (c *collisions) Report(service string, err error) {
+	c.Lock()
+	defer c.Unlock()
+	log.Errorf("Service %s: %v", service, err)
+	c.errs[service] = err.Error()
+}
+
+func (c *collisions) status() map[string]string {
+	c.Lock()
+	defer c.Unlock()
+	errs := make(map[string]string)
+	for k, v := range c.errs {
+		errs[k] = v
+	}
+	return errs
+}
+
+func adminCollisions(w http.ResponseWriter, req *http.Request) {
+	b, _ := json.MarshalIndent(p.collisions.status(), "", " ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// writeFileAtomic replaces path with data so that readers never see a
+// partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// adoption is the snapshot of an adopted VS's original config, kept
+// locally when snapshots are enabled.
+type adoption struct {
+	Name     string                 `json:"name"`
+	Snapshot map[string]interface{} `json:"snapshot"`
+}
+
+// adoptionPath returns the snapshot file of the adopted VS, after a hash
+// of its name as VS names may hold any character.
+func (p *Avi) adoptionPath(vsName string) string {
+	return filepath.Join(p.cfg.stateDir, "adopted", fmt.Sprintf("%x.json", sha256.Sum256([]byte(vsName))))
+}
+
+// VsAdoption returns the original created_by of the VS and true if the
+// VS was adopted from another owner. The mark lives on the VS itself, so
+// that adopted VSes are handed back even when local state is lost.
+func VsAdoption(vs map[string]interface{}) (string, bool) {
+	labels, ok := vs["labels"].([]interface{})
+	if !ok {
+		return "", false
+	}
+	for _, l := range labels {
+		kv, ok := l.(map[string]interface{})
+		if !ok || kv["key"] != AVI_ADOPTED_LABEL {
+			continue
+		}
+		createdBy, _ := kv["value"].(string)
+		return createdBy, true
+	}
+	return "", false
+}
+
+// setAdoptedLabel returns the VS labels with the adopted label set to the
+// original created_by, or cleared, leaving any other labels untouched.
+func setAdoptedLabel(labels interface{}, createdBy string, adopted bool) []interface{} {
+	retained := make([]interface{}, 0)
+	if ls, ok := labels.([]interface{}); ok {
+		for _, l := range ls {
+			kv, ok := l.(map[string]interface{})
+			if ok && kv["key"] == AVI_ADOPTED_LABEL {
+				continue
+			}
+			retained = append(retained, l)
+		}
+	}
+	if adopted {
+		kv := make(map[string]interface{})
+		kv["key"] = AVI_ADOPTED_LABEL
+		kv["value"] = createdBy
+		retained = append(retained, kv)
+	}
+	return retained
+}
+
+// AdoptVS takes ownership of a VS which was not created by Rancher. Its
+// original owner is kept in a label on the VS, and its config is saved
+// first if snapshots are enabled, globally or for the service.
+func (p *Avi) AdoptVS(task *Vservice, vs map[string]interface{}) error {
+	vsName := vs["name"].(string)
+	if p.cfg.adoptSnapshot || labelEnabled(task.labels, AVI_ADOPT_SNAPSHOT_LABEL) {
+		b, err := json.MarshalIndent(adoption{Name: vsName, Snapshot: vs}, "", " ")
+		if err != nil {
+			return err
+		}
+		path := p.adoptionPath(vsName)
+		if err := writeFileAtomic(path, b); err != nil {
+			log.Errorf("Failed to save snapshot of VS %s before adoption: %v", vsName, err)
+			return err
+		}
+		log.Infof("Saved snapshot of VS %s to %s", vsName, path)
+	}
+
+	log.Infof("Adopting VS %s for service %s", vsName, task.serviceName)
+	createdBy, _ := vs["created_by"].(string)
+	vs["labels"] = setAdoptedLabel(vs["labels"], createdBy, true)
+	// the VS gets a pool group from Rancher; both refs can't be set
+	delete(vs, "pool_ref")
+	p.CreateUpdateVS(task, false, vs)
+	return nil
+}
+
+// ReleaseVS hands an adopted VS back: restored to the config saved before
+// adoption if there is a snapshot, else as it is, with its original owner.
+func (p *Avi) ReleaseVS(vs map[string]interface{}) error {
+	vsName := vs["name"].(string)
+	path := p.adoptionPath(vsName)
+	var orig map[string]interface{}
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		var adopted adoption
+		if err := json.Unmarshal(b, &adopted); err != nil {
+			log.Errorf("Invalid snapshot %s of VS %s: %v", path, vsName, err)
+			return err
+		}
+		orig = adopted.Snapshot
+	} else if !os.IsNotExist(err) {
+		log.Errorf("Failed to read snapshot %s of VS %s: %v", path, vsName, err)
+		return err
+	}
+
+	if orig == nil {
+		createdBy, _ := VsAdoption(vs)
+		orig = vs
+		orig["labels"] = setAdoptedLabel(orig["labels"], "", false)
+		delete(orig, "created_by")
+		if createdBy != "" {
+			orig["created_by"] = createdBy
+		}
+	}
+	orig["uuid"] = vs["uuid"]
+	// the VS has been modified since the snapshot was taken
+	delete(orig, "_last_modified")
+	res, err := p.aviSession.Put("/api/virtualservice/"+vs["uuid"].(string), orig)
+	if err != nil {
+		log.Errorf("Error releasing VS %s: %v", vsName, res)
+		return err
+	}
+	if b != nil {
+		log.Infof("VS %s released and restored from snapshot", vsName)
+		return os.Remove(path)
+	}
+	log.Infof("VS %s released", vsName)
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAdoptionPath(t *testing.T) {
+	p := &Avi{cfg: &AviConfig{stateDir: "/var/lib/avi-rancher"}}
+	dir := filepath.Join("/var/lib/avi-rancher", "adopted")
+	seen := make(map[string]string)
+	for _, name := range []string{"web", "../../../etc/cron.d/x", "a/b", "..", "web.json"} {
+		path := p.adoptionPath(name)
+		if filepath.Dir(path) != dir {
+			t.Errorf("record of VS %q at %s, outside %s", name, path, dir)
+		}
+		if other, ok := seen[path]; ok {
+			t.Errorf("VSes %q and %q share record %s", name, other, path)
+		}
+		seen[path] = name
+	}
+}
+
+func TestAdoptedLabel(t *testing.T) {
+	protected := map[string]interface{}{"key": AVI_PROTECTED_LABEL, "value": "true"}
+	labels := setAdoptedLabel([]interface{}{protected}, "admin", true)
+	vs := map[string]interface{}{"labels": labels}
+	if createdBy, adopted := VsAdoption(vs); !adopted || createdBy != "admin" {
+		t.Errorf("VsAdoption = %q, %v, want admin, true", createdBy, adopted)
+	}
+	if !VsIsProtected(vs) {
+		t.Errorf("other labels lost: %v", labels)
+	}
+	labels = setAdoptedLabel(labels, "", false)
+	if _, adopted := VsAdoption(map[string]interface{}{"labels": labels}); adopted || len(labels) != 1 {
+		t.Errorf("adopted label not cleared: %v", labels)
+	}
+	if _, adopted := VsAdoption(map[string]interface{}{"created_by": CREATED_BY}); adopted {
+		t.Errorf("VS without labels is adopted")
+	}
+}
+
+// adoptedVS is an adopted VS as read back from the controller.
+func adoptedVS() map[string]interface{} {
+	return map[string]interface{}{
+		"uuid":       "virtualservice-1",
+		"name":       "shop",
+		"created_by": CREATED_BY,
+		"labels":     setAdoptedLabel(nil, "terraform", true),
+	}
+}
+
+func TestReleaseVSWithoutSnapshot(t *testing.T) {
+	session, reqs := fakeAvi(t, func(req aviRequest) interface{} { return req.body })
+	p := &Avi{aviSession: session, cfg: &AviConfig{stateDir: t.TempDir()}}
+	if err := p.ReleaseVS(adoptedVS()); err != nil {
+		t.Fatal(err)
+	}
+	if len(*reqs) != 1 {
+		t.Fatalf("got requests %v, want one PUT", *reqs)
+	}
+	req := (*reqs)[0]
+	if req.method != "PUT" || req.path != "//api/virtualservice/virtualservice-1" {
+		t.Errorf("got %s %s, want a PUT of the VS", req.method, req.path)
+	}
+	if req.body["created_by"] != "terraform" {
+		t.Errorf("created_by = %v, want the original owner", req.body["created_by"])
+	}
+	if _, adopted := VsAdoption(req.body); adopted {
+		t.Errorf("released VS still marked adopted: %v", req.body["labels"])
+	}
+}
+
+func TestReleaseVSFromSnapshot(t *testing.T) {
+	session, reqs := fakeAvi(t, func(req aviRequest) interface{} { return req.body })
+	p := &Avi{aviSession: session, cfg: &AviConfig{stateDir: t.TempDir()}}
+	snapshot := map[string]interface{}{"name": "shop", "created_by": "terraform", "pool_ref": "/api/pool/pool-1"}
+	b, err := json.Marshal(adoption{Name: "shop", Snapshot: snapshot})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := p.adoptionPath("shop")
+	if err := writeFileAtomic(path, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.ReleaseVS(adoptedVS()); err != nil {
+		t.Fatal(err)
+	}
+	if len(*reqs) != 1 {
+		t.Fatalf("got requests %v, want one PUT", *reqs)
+	}
+	body := (*reqs)[0].body
+	if body["pool_ref"] != "/api/pool/pool-1" || body["uuid"] != "virtualservice-1" || body["labels"] != nil {
+		t.Errorf("VS not restored from snapshot: %v", body)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("snapshot %s kept after release", path)
+	}
+}
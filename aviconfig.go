@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 )
 
@@ -20,6 +21,51 @@ const (
 	AVI_CLOUD_NAME           = "AVI_CLOUD_NAME"
 	AVI_DNS_SUBDOMAIN        = "AVI_DNS_SUBDOMAIN"
 	AVI_TENANT               = "AVI_TENANT"
+	AVI_DELETE_GRACE_CYCLES  = "AVI_DELETE_GRACE_CYCLES"
+	AVI_DELETE_GRACE_PERIOD  = "AVI_DELETE_GRACE_PERIOD"
+	AVI_MAX_DELETES          = "AVI_MAX_DELETES"
+	AVI_MAX_DELETE_PERCENT   = "AVI_MAX_DELETE_PERCENT"
+	AVI_DELETE_DRY_RUN       = "AVI_DELETE_DRY_RUN"
+	AVI_ADMIN_TOKEN          = "AVI_ADMIN_TOKEN"
+	AVI_STATE_DIR            = "AVI_STATE_DIR"
+	AVI_ADOPT_SNAPSHOT       = "AVI_ADOPT_SNAPSHOT"
+	AVI_VS_NAME_TEMPLATE     = "AVI_VS_NAME_TEMPLATE"
+	AVI_POOL_NAME_TEMPLATE   = "AVI_POOL_NAME_TEMPLATE"
+	AVI_ZONE_POOL_NAME_TEMPLATE = "AVI_ZONE_POOL_NAME_TEMPLATE"
+	AVI_POOLGROUP_NAME_TEMPLATE = "AVI_POOLGROUP_NAME_TEMPLATE"
+	AVI_VSVIP_NAME_TEMPLATE  = "AVI_VSVIP_NAME_TEMPLATE"
+	AVI_FQDN_TEMPLATE        = "AVI_FQDN_TEMPLATE"
+	AVI_NAME_MAX_LENGTH      = "AVI_NAME_MAX_LENGTH"
+	AVI_HOST_IP_LABEL        = "AVI_HOST_IP_LABEL"
+	AVI_MAINTENANCE_LABEL    = "AVI_MAINTENANCE_LABEL"
+	AVI_ZONE_LABEL           = "AVI_ZONE_LABEL"
+	AVI_LOCAL_ZONE           = "AVI_LOCAL_ZONE"
+	AVI_BACKEND_MODE         = "AVI_BACKEND_MODE"
+	AVI_PLACEMENT_NETWORK    = "AVI_PLACEMENT_NETWORK"
+	AVI_PLACEMENT_SUBNET     = "AVI_PLACEMENT_SUBNET"
+	AVI_VIP_TYPE             = "AVI_VIP_TYPE"
+	AVI_DISCOVERY_MODE       = "AVI_DISCOVERY_MODE"
+	AVI_ENABLE_LABEL         = "AVI_ENABLE_LABEL"
+	AVI_LABEL_SELECTOR       = "AVI_LABEL_SELECTOR"
+	AVI_INCLUDE_STACKS       = "AVI_INCLUDE_STACKS"
+	AVI_EXCLUDE_STACKS       = "AVI_EXCLUDE_STACKS"
+	AVI_INCLUDE_SERVICES     = "AVI_INCLUDE_SERVICES"
+	AVI_EXCLUDE_SERVICES     = "AVI_EXCLUDE_SERVICES"
+	AVI_INCLUDE_KINDS        = "AVI_INCLUDE_KINDS"
+	AVI_EXCLUDE_KINDS        = "AVI_EXCLUDE_KINDS"
+	AVI_EXCLUDE_SYSTEM       = "AVI_EXCLUDE_SYSTEM"
+	AVI_CHANGE_DEBOUNCE      = "AVI_CHANGE_DEBOUNCE"
+	AVI_RESYNC_INTERVAL      = "AVI_RESYNC_INTERVAL"
+	AVI_STATE_FILE           = "AVI_STATE_FILE"
+	AVI_SHRINK_THRESHOLD     = "AVI_SHRINK_THRESHOLD"
+	AVI_DRAIN_PERIOD         = "AVI_DRAIN_PERIOD"
+	AVI_SOURCE               = "AVI_SOURCE"
+	AVI_SOURCE_FILE          = "AVI_SOURCE_FILE"
+	AVI_ENVIRONMENT          = "AVI_ENVIRONMENT"
+	AVI_DOCKER_SOCKET        = "AVI_DOCKER_SOCKET"
+	AVI_DOCKER_HOST_IP       = "AVI_DOCKER_HOST_IP"
+	AVI_KUBE_CONFIG          = "AVI_KUBE_CONFIG"
+	AVI_KUBE_NAMESPACE       = "AVI_KUBE_NAMESPACE"
 
 	// Avi password configured as avi-creds secret in Rancher
 	AVI_SECRETES_FILE = "/run/secrets/avi-creds"
@@ -35,6 +81,57 @@ type AviConfig struct {
 	cloudName        string
 	dnsSubDomain     string
 	tenant         string
+
+	// deletion safeguards
+	deleteGraceCycles  int // consecutive cycles a VS must be missing
+	deleteGracePeriod  int // seconds a VS must be missing
+	maxDeletes         int // max VS deletions per cycle, 0 disables
+	maxDeletePercent   int // max % of managed VSes deleted per cycle, 0 disables
+	deleteDryRun       bool
+	adminToken         string // bearer token of the admin actions, disabled if empty
+
+	stateDir      string // local state such as adoption snapshots
+	adoptSnapshot bool   // snapshot foreign VSes before adopting them
+
+	namer        *aviNamer
+	fqdnTemplate bool // FQDNs are configured even without a subdomain
+
+	hostIPLabel string // host label overriding the agent IP for 0.0.0.0 bindings
+
+	maintenanceLabel string // host label disabling all members on the host
+
+	zoneLabel string // host label splitting members into a pool per zone
+	localZone string // zone preferred for traffic, the agent's own if empty
+
+	backendMode      string // hostport or container
+	placementNetwork string // network and subnet SEs reach containers on
+	placementSubnet  string
+
+	vipType string // v4, v6 or dual
+
+	discoveryMode string // opt-out, opt-in or selector
+	enableLabel   string // label opting a service in
+	labelSelector labelSelector
+
+	filter *serviceFilter
+
+	changeDebounce int // milliseconds to wait for metadata changes to settle
+	resyncInterval int // seconds between full resyncs
+
+	stateFile       string // last good desired state
+	shrinkThreshold int    // % of the last good state below which deletes are refused
+
+	drainPeriod int // seconds removed members stay disabled before deletion
+
+	source      string // where services come from
+	sourceFile  string // services of the file source
+	environment string // environment in VS names of sources other than rancher
+
+	dockerSocket string // Docker Engine API socket of the docker source
+	dockerHostIP string // address of ports the docker host publishes on all interfaces
+
+	kubeConfig    string // kubeconfig of the kubernetes source, in-cluster if empty
+	kubeNamespace string // namespace of the kubernetes source, all if empty
 }
 
 func getAviPasswd() string {
@@ -63,6 +160,60 @@ func GetAviConfig() (*AviConfig, error) {
 	conf[AVI_DNS_SUBDOMAIN] = os.Getenv(AVI_DNS_SUBDOMAIN)
 	conf[AVI_TENANT] = os.Getenv(AVI_TENANT)
 
+	conf[AVI_DELETE_GRACE_CYCLES] = os.Getenv(AVI_DELETE_GRACE_CYCLES)
+	conf[AVI_DELETE_GRACE_PERIOD] = os.Getenv(AVI_DELETE_GRACE_PERIOD)
+	conf[AVI_MAX_DELETES] = os.Getenv(AVI_MAX_DELETES)
+	conf[AVI_MAX_DELETE_PERCENT] = os.Getenv(AVI_MAX_DELETE_PERCENT)
+	conf[AVI_DELETE_DRY_RUN] = os.Getenv(AVI_DELETE_DRY_RUN)
+	conf[AVI_ADMIN_TOKEN] = os.Getenv(AVI_ADMIN_TOKEN)
+	conf[AVI_STATE_DIR] = os.Getenv(AVI_STATE_DIR)
+	conf[AVI_ADOPT_SNAPSHOT] = os.Getenv(AVI_ADOPT_SNAPSHOT)
+
+	conf[AVI_VS_NAME_TEMPLATE] = os.Getenv(AVI_VS_NAME_TEMPLATE)
+	conf[AVI_POOL_NAME_TEMPLATE] = os.Getenv(AVI_POOL_NAME_TEMPLATE)
+	conf[AVI_ZONE_POOL_NAME_TEMPLATE] = os.Getenv(AVI_ZONE_POOL_NAME_TEMPLATE)
+	conf[AVI_POOLGROUP_NAME_TEMPLATE] = os.Getenv(AVI_POOLGROUP_NAME_TEMPLATE)
+	conf[AVI_VSVIP_NAME_TEMPLATE] = os.Getenv(AVI_VSVIP_NAME_TEMPLATE)
+	conf[AVI_FQDN_TEMPLATE] = os.Getenv(AVI_FQDN_TEMPLATE)
+	conf[AVI_NAME_MAX_LENGTH] = os.Getenv(AVI_NAME_MAX_LENGTH)
+	conf[AVI_HOST_IP_LABEL] = os.Getenv(AVI_HOST_IP_LABEL)
+	conf[AVI_MAINTENANCE_LABEL] = os.Getenv(AVI_MAINTENANCE_LABEL)
+	conf[AVI_ZONE_LABEL] = os.Getenv(AVI_ZONE_LABEL)
+	conf[AVI_LOCAL_ZONE] = os.Getenv(AVI_LOCAL_ZONE)
+	conf[AVI_BACKEND_MODE] = os.Getenv(AVI_BACKEND_MODE)
+	conf[AVI_PLACEMENT_NETWORK] = os.Getenv(AVI_PLACEMENT_NETWORK)
+	conf[AVI_PLACEMENT_SUBNET] = os.Getenv(AVI_PLACEMENT_SUBNET)
+	conf[AVI_VIP_TYPE] = os.Getenv(AVI_VIP_TYPE)
+	conf[AVI_DISCOVERY_MODE] = os.Getenv(AVI_DISCOVERY_MODE)
+	conf[AVI_ENABLE_LABEL] = os.Getenv(AVI_ENABLE_LABEL)
+	conf[AVI_LABEL_SELECTOR] = os.Getenv(AVI_LABEL_SELECTOR)
+
+	conf[AVI_INCLUDE_STACKS] = os.Getenv(AVI_INCLUDE_STACKS)
+	conf[AVI_INCLUDE_SERVICES] = os.Getenv(AVI_INCLUDE_SERVICES)
+	conf[AVI_EXCLUDE_SERVICES] = os.Getenv(AVI_EXCLUDE_SERVICES)
+	conf[AVI_INCLUDE_KINDS] = os.Getenv(AVI_INCLUDE_KINDS)
+	conf[AVI_EXCLUDE_KINDS] = os.Getenv(AVI_EXCLUDE_KINDS)
+	// unlike the other settings an empty exclude list is meaningful
+	if val, ok := os.LookupEnv(AVI_EXCLUDE_STACKS); ok {
+		conf[AVI_EXCLUDE_STACKS] = val
+	} else {
+		conf[AVI_EXCLUDE_STACKS] = DEFAULT_EXCLUDE_STACKS
+	}
+	conf[AVI_EXCLUDE_SYSTEM] = os.Getenv(AVI_EXCLUDE_SYSTEM)
+
+	conf[AVI_CHANGE_DEBOUNCE] = os.Getenv(AVI_CHANGE_DEBOUNCE)
+	conf[AVI_RESYNC_INTERVAL] = os.Getenv(AVI_RESYNC_INTERVAL)
+	conf[AVI_STATE_FILE] = os.Getenv(AVI_STATE_FILE)
+	conf[AVI_SHRINK_THRESHOLD] = os.Getenv(AVI_SHRINK_THRESHOLD)
+	conf[AVI_DRAIN_PERIOD] = os.Getenv(AVI_DRAIN_PERIOD)
+	conf[AVI_SOURCE] = os.Getenv(AVI_SOURCE)
+	conf[AVI_SOURCE_FILE] = os.Getenv(AVI_SOURCE_FILE)
+	conf[AVI_ENVIRONMENT] = os.Getenv(AVI_ENVIRONMENT)
+	conf[AVI_DOCKER_SOCKET] = os.Getenv(AVI_DOCKER_SOCKET)
+	conf[AVI_DOCKER_HOST_IP] = os.Getenv(AVI_DOCKER_HOST_IP)
+	conf[AVI_KUBE_CONFIG] = os.Getenv(AVI_KUBE_CONFIG)
+	conf[AVI_KUBE_NAMESPACE] = os.Getenv(AVI_KUBE_NAMESPACE)
+
 	conf[AVI_PASSWORD] = getAviPasswd()
 
 	b, _ := json.MarshalIndent(conf, "", " ")
@@ -143,5 +294,190 @@ func validateConfig(conf map[string]string) (*AviConfig, error) {
 		cfg.dnsSubDomain = conf[AVI_DNS_SUBDOMAIN]
 	}
 
+	if cfg.deleteGraceCycles, err = intConf(conf, AVI_DELETE_GRACE_CYCLES, 3); err != nil {
+		return cfg, err
+	}
+	if cfg.deleteGracePeriod, err = intConf(conf, AVI_DELETE_GRACE_PERIOD, 60); err != nil {
+		return cfg, err
+	}
+	if cfg.maxDeletes, err = intConf(conf, AVI_MAX_DELETES, 5); err != nil {
+		return cfg, err
+	}
+	if cfg.maxDeletePercent, err = intConf(conf, AVI_MAX_DELETE_PERCENT, 50); err != nil {
+		return cfg, err
+	}
+	cfg.deleteDryRun = boolConf(conf, AVI_DELETE_DRY_RUN)
+	cfg.adminToken = conf[AVI_ADMIN_TOKEN]
+	if cfg.adminToken == "" {
+		log.Info("AVI_ADMIN_TOKEN not set, admin actions are disabled")
+	}
+
+	if conf[AVI_STATE_DIR] == "" {
+		log.Info("AVI_STATE_DIR not set, using /var/lib/avi-rancher")
+		conf[AVI_STATE_DIR] = "/var/lib/avi-rancher"
+	}
+	cfg.stateDir = conf[AVI_STATE_DIR]
+	cfg.adoptSnapshot = boolConf(conf, AVI_ADOPT_SNAPSHOT)
+
+	cfg.fqdnTemplate = conf[AVI_FQDN_TEMPLATE] != ""
+	defaults := map[string]string{
+		AVI_VS_NAME_TEMPLATE:        DEFAULT_VS_NAME_TEMPLATE,
+		AVI_POOL_NAME_TEMPLATE:      DEFAULT_POOL_NAME_TEMPLATE,
+		AVI_ZONE_POOL_NAME_TEMPLATE: DEFAULT_ZONE_POOL_NAME_TEMPLATE,
+		AVI_POOLGROUP_NAME_TEMPLATE: DEFAULT_POOLGROUP_NAME_TEMPLATE,
+		AVI_VSVIP_NAME_TEMPLATE:     DEFAULT_VSVIP_NAME_TEMPLATE,
+		AVI_FQDN_TEMPLATE:           DEFAULT_FQDN_TEMPLATE,
+	}
+	for key, def := range defaults {
+		if conf[key] == "" {
+			conf[key] = def
+		}
+	}
+	maxLen, err := intConf(conf, AVI_NAME_MAX_LENGTH, DEFAULT_NAME_MAX_LENGTH)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.namer, err = NewAviNamer(conf[AVI_VS_NAME_TEMPLATE],
+		conf[AVI_POOL_NAME_TEMPLATE],
+		conf[AVI_ZONE_POOL_NAME_TEMPLATE],
+		conf[AVI_POOLGROUP_NAME_TEMPLATE],
+		conf[AVI_VSVIP_NAME_TEMPLATE],
+		conf[AVI_FQDN_TEMPLATE],
+		maxLen)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.hostIPLabel = conf[AVI_HOST_IP_LABEL]
+
+	if conf[AVI_MAINTENANCE_LABEL] == "" {
+		conf[AVI_MAINTENANCE_LABEL] = DEFAULT_MAINTENANCE_LABEL
+	}
+	cfg.maintenanceLabel = conf[AVI_MAINTENANCE_LABEL]
+	cfg.zoneLabel = conf[AVI_ZONE_LABEL]
+	cfg.localZone = conf[AVI_LOCAL_ZONE]
+
+	switch conf[AVI_BACKEND_MODE] {
+	case "":
+		conf[AVI_BACKEND_MODE] = BACKEND_MODE_HOSTPORT
+	case BACKEND_MODE_HOSTPORT, BACKEND_MODE_CONTAINER:
+	default:
+		return cfg, fmt.Errorf("Invalid value for %s: %s", AVI_BACKEND_MODE, conf[AVI_BACKEND_MODE])
+	}
+	cfg.backendMode = conf[AVI_BACKEND_MODE]
+	cfg.placementNetwork = conf[AVI_PLACEMENT_NETWORK]
+	cfg.placementSubnet = conf[AVI_PLACEMENT_SUBNET]
+
+	switch conf[AVI_VIP_TYPE] {
+	case "":
+		conf[AVI_VIP_TYPE] = VIP_TYPE_V4
+	case VIP_TYPE_V4, VIP_TYPE_V6, VIP_TYPE_DUAL:
+	default:
+		return cfg, fmt.Errorf("Invalid value for %s: %s", AVI_VIP_TYPE, conf[AVI_VIP_TYPE])
+	}
+	cfg.vipType = conf[AVI_VIP_TYPE]
+
+	switch conf[AVI_DISCOVERY_MODE] {
+	case "":
+		log.Info("AVI_DISCOVERY_MODE not set, using opt-out")
+		conf[AVI_DISCOVERY_MODE] = DISCOVERY_OPT_OUT
+	case DISCOVERY_OPT_OUT, DISCOVERY_OPT_IN:
+	case DISCOVERY_SELECTOR:
+		if conf[AVI_LABEL_SELECTOR] == "" {
+			return cfg, fmt.Errorf("AVI_LABEL_SELECTOR not set")
+		}
+	default:
+		return cfg, fmt.Errorf("Invalid value for %s: %s", AVI_DISCOVERY_MODE, conf[AVI_DISCOVERY_MODE])
+	}
+	cfg.discoveryMode = conf[AVI_DISCOVERY_MODE]
+	if conf[AVI_ENABLE_LABEL] == "" {
+		conf[AVI_ENABLE_LABEL] = DEFAULT_ENABLE_LABEL
+	}
+	cfg.enableLabel = conf[AVI_ENABLE_LABEL]
+	if cfg.labelSelector, err = parseLabelSelector(conf[AVI_LABEL_SELECTOR]); err != nil {
+		return cfg, err
+	}
+
+	cfg.filter = new(serviceFilter)
+	filters := map[string]*nameFilter{
+		AVI_INCLUDE_STACKS:   &cfg.filter.includeStacks,
+		AVI_EXCLUDE_STACKS:   &cfg.filter.excludeStacks,
+		AVI_INCLUDE_SERVICES: &cfg.filter.includeServices,
+		AVI_EXCLUDE_SERVICES: &cfg.filter.excludeServices,
+		AVI_INCLUDE_KINDS:    &cfg.filter.includeKinds,
+		AVI_EXCLUDE_KINDS:    &cfg.filter.excludeKinds,
+	}
+	for key, filter := range filters {
+		if *filter, err = parseNameFilter(conf[key]); err != nil {
+			return cfg, err
+		}
+	}
+	cfg.filter.excludeSystem = conf[AVI_EXCLUDE_SYSTEM] == "" || boolConf(conf, AVI_EXCLUDE_SYSTEM)
+
+	if cfg.changeDebounce, err = intConf(conf, AVI_CHANGE_DEBOUNCE, 2000); err != nil {
+		return cfg, err
+	}
+	if cfg.resyncInterval, err = intConf(conf, AVI_RESYNC_INTERVAL, 300); err != nil {
+		return cfg, err
+	}
+	if cfg.resyncInterval == 0 {
+		return cfg, fmt.Errorf("%s must be greater than 0", AVI_RESYNC_INTERVAL)
+	}
+
+	if conf[AVI_STATE_FILE] == "" {
+		conf[AVI_STATE_FILE] = filepath.Join(cfg.stateDir, "state.json")
+	}
+	cfg.stateFile = conf[AVI_STATE_FILE]
+	if cfg.shrinkThreshold, err = intConf(conf, AVI_SHRINK_THRESHOLD, 50); err != nil {
+		return cfg, err
+	}
+
+	if cfg.drainPeriod, err = intConf(conf, AVI_DRAIN_PERIOD, 30); err != nil {
+		return cfg, err
+	}
+
+	if conf[AVI_SOURCE] == "" {
+		conf[AVI_SOURCE] = SOURCE_RANCHER
+	}
+	cfg.source = conf[AVI_SOURCE]
+	cfg.sourceFile = conf[AVI_SOURCE_FILE]
+	// Rancher names VSes after its own environment
+	if conf[AVI_ENVIRONMENT] == "" && cfg.source != SOURCE_RANCHER {
+		conf[AVI_ENVIRONMENT] = cfg.source
+	}
+	cfg.environment = conf[AVI_ENVIRONMENT]
+
+	if conf[AVI_DOCKER_SOCKET] == "" {
+		conf[AVI_DOCKER_SOCKET] = DEFAULT_DOCKER_SOCKET
+	}
+	cfg.dockerSocket = conf[AVI_DOCKER_SOCKET]
+	cfg.dockerHostIP = conf[AVI_DOCKER_HOST_IP]
+	cfg.kubeConfig = conf[AVI_KUBE_CONFIG]
+	cfg.kubeNamespace = conf[AVI_KUBE_NAMESPACE]
+
 	return cfg, nil
 }
+
+// intConf parses a non-negative integer setting, falling back to def
+// when it is not set.
+func intConf(conf map[string]string, key string, def int) (int, error) {
+	if conf[key] == "" {
+		log.Infof("%s not set, using %d", key, def)
+		return def, nil
+	}
+	val, err := strconv.Atoi(conf[key])
+	if err != nil || val < 0 {
+		return def, fmt.Errorf("Invalid value for %s: %s", key, conf[key])
+	}
+	return val, nil
+}
+
+// boolConf treats anything other than empty, "no" and "false" as true.
+func boolConf(conf map[string]string, key string) bool {
+	if conf[key] == "" ||
+		conf[key] == "no" ||
+		conf[key] == "false" {
+		return false
+	}
+	return true
+}
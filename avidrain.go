@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	AVI_DRAIN_PERIOD_LABEL = "avi_drain_period"
+
+	// how often draining members are checked, in seconds
+	drainPollInterval = 10
+)
+
+// drainingMember is a pool member which left the service and is kept
+// disabled until its connections are drained.
+type drainingMember struct {
+	member pool
+	since  time.Time
+}
+
+// connCounter returns the open connections of a pool server of a VS.
+type connCounter func(vsName string, ip string, port int) (float64, error)
+
+// drainer keeps members which disappear from a service in its pool,
+// disabled, for a drain period or until they have no connections left, so
+// that in-flight requests are not cut.
+type drainer struct {
+	sync.Mutex
+	period   time.Duration
+	notify   func(change string)
+	last     map[string]map[string]pool
+	draining map[string]map[string]*drainingMember
+	timer    *time.Timer
+}
+
+func NewDrainer(cfg *AviConfig, notify func(change string)) *drainer {
+	return &drainer{
+		period:   time.Duration(cfg.drainPeriod) * time.Second,
+		notify:   notify,
+		last:     make(map[string]map[string]pool),
+		draining: make(map[string]map[string]*drainingMember),
+	}
+}
+
+func memberKey(pl pool) string {
+	return makeKey(pl.hostip, strconv.Itoa(pl.frontPort()))
+}
+
+// drainPeriod returns the drain period of the service, from the
+// avi_drain_period label if set.
+func (d *drainer) drainPeriod(dt *Vservice) time.Duration {
+	val, ok := dt.labels[AVI_DRAIN_PERIOD_LABEL]
+	if !ok {
+		return d.period
+	}
+	secs, err := strconv.Atoi(val)
+	if err != nil || secs < 0 {
+		log.Warnf("Invalid %s label %s on VS %s", AVI_DRAIN_PERIOD_LABEL, val, dt.serviceName)
+		return d.period
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// Apply adds the members still draining to tasks, disabled, and forgets
+// those which are drained.
+func (d *drainer) Apply(tasks map[string]*Vservice, open connCounter) {
+	d.Lock()
+	defer d.Unlock()
+
+	now := time.Now()
+	last := make(map[string]map[string]pool)
+	for name, dt := range tasks {
+		current := make(map[string]pool)
+		for _, pl := range dt.pools {
+			current[memberKey(pl)] = pl
+		}
+		last[name] = current
+
+		period := d.drainPeriod(dt)
+		draining := d.draining[name]
+		if draining == nil {
+			draining = make(map[string]*drainingMember)
+		}
+		if period > 0 {
+			for key, pl := range d.last[name] {
+				if _, ok := current[key]; ok {
+					continue
+				}
+				if _, ok := draining[key]; !ok {
+					log.Infof("Draining member %s of VS %s", key, name)
+					draining[key] = &drainingMember{member: pl, since: now}
+				}
+			}
+		}
+
+		for key, dm := range draining {
+			if _, ok := current[key]; ok {
+				// back before it was drained
+				delete(draining, key)
+				continue
+			}
+			if now.Sub(dm.since) >= period {
+				log.Infof("Drain period of member %s of VS %s over", key, name)
+				delete(draining, key)
+				continue
+			}
+			// connections are only looked at once the member was disabled
+			if now.After(dm.since) && open != nil {
+				conns, err := open(name, dm.member.hostip, dm.member.frontPort())
+				if err == nil && conns == 0 {
+					log.Infof("Member %s of VS %s drained", key, name)
+					delete(draining, key)
+					continue
+				}
+			}
+			member := dm.member
+			member.enabled = false
+			dt.pools = append(dt.pools, member)
+		}
+		if len(draining) > 0 {
+			d.draining[name] = draining
+		} else {
+			delete(d.draining, name)
+		}
+	}
+	// VSes which went away are deleted as a whole
+	for name := range d.draining {
+		if _, ok := tasks[name]; !ok {
+			delete(d.draining, name)
+		}
+	}
+	d.last = last
+
+	if len(d.draining) > 0 && d.timer == nil && d.notify != nil {
+		d.timer = time.AfterFunc(drainPollInterval*time.Second, func() {
+			d.Lock()
+			d.timer = nil
+			d.Unlock()
+			d.notify("members draining")
+		})
+	}
+}
+
+// OpenConnections returns the average open connections of a pool server
+// over the last metrics interval. The server is looked for in every pool
+// of the VS's pool group, as pools split by zone or service are not named
+// after their members.
+func (p *Avi) OpenConnections(vsName string, ip string, port int) (float64, error) {
+	vs, err := p.GetVS(vsName)
+	if err != nil {
+		return 0, err
+	}
+	res, err := p.aviSession.Get("/api/poolgroup/" + refUuid(vs["pool_group_ref"]))
+	if err != nil {
+		return 0, err
+	}
+	pg, _ := res.(map[string]interface{})
+	members, _ := pg["members"].([]interface{})
+	for _, member := range members {
+		pgmem, _ := member.(map[string]interface{})
+		if val, ok := p.serverOpenConnections(refUuid(pgmem["pool_ref"]), ip, port); ok {
+			return val, nil
+		}
+	}
+	return 0, fmt.Errorf("No connection metrics for server %s:%d of VS %s", ip, port, vsName)
+}
+
+// serverOpenConnections returns the open connections of a server of the
+// pool with that uuid, if the pool has metrics for it.
+func (p *Avi) serverOpenConnections(poolUuid string, ip string, port int) (float64, bool) {
+	uri := fmt.Sprintf("/api/analytics/metrics/pool/%s/?metric_id=l4_server.avg_open_conns&obj_id=%s:%d&step=5&limit=1",
+		poolUuid, ip, port)
+	res, err := p.aviSession.Get(uri)
+	if err != nil {
+		return 0, false
+	}
+	metrics, _ := res.(map[string]interface{})
+	series, _ := metrics["series"].([]interface{})
+	for _, s := range series {
+		data, _ := s.(map[string]interface{})["data"].([]interface{})
+		for _, d := range data {
+			if val, ok := d.(map[string]interface{})["value"].(float64); ok {
+				return val, true
+			}
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func drainTask(labels map[string]string, ips ...string) map[string]*Vservice {
+	dt := &Vservice{serviceName: "web", labels: labels}
+	for _, ip := range ips {
+		dt.pools = append(dt.pools, pool{hostip: ip, ports: map[int]int{8080: 80}, enabled: true})
+	}
+	return map[string]*Vservice{"web": dt}
+}
+
+// poolMembers returns whether each member of the VS is enabled.
+func poolMembers(tasks map[string]*Vservice) map[string]bool {
+	mems := make(map[string]bool)
+	for _, pl := range tasks["web"].pools {
+		mems[pl.hostip] = pl.enabled
+	}
+	return mems
+}
+
+// fakeCounter counts the open connections of every server as conns.
+type fakeCounter struct {
+	conns float64
+	err   error
+	calls int
+}
+
+func (c *fakeCounter) open(vsName string, ip string, port int) (float64, error) {
+	c.calls++
+	return c.conns, c.err
+}
+
+// backdate moves the start of every drain back by age.
+func backdate(d *drainer, age time.Duration) {
+	for _, draining := range d.draining {
+		for _, dm := range draining {
+			dm.since = dm.since.Add(-age)
+		}
+	}
+}
+
+func TestDrainerApply(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		labels  map[string]string
+		conns   float64
+		err     error
+		age     time.Duration // of the drain before the last cycle
+		members map[string]bool
+		calls   int
+	}{
+		{"draining", nil, 5, nil, 10 * time.Second, map[string]bool{"10.0.0.1": true, "10.0.0.2": false}, 1},
+		{"drain period over", nil, 5, nil, time.Minute, map[string]bool{"10.0.0.1": true}, 0},
+		{"no connections left", nil, 0, nil, 10 * time.Second, map[string]bool{"10.0.0.1": true}, 1},
+		{"connections unknown", nil, 0, fmt.Errorf("no metrics"), 10 * time.Second, map[string]bool{"10.0.0.1": true, "10.0.0.2": false}, 1},
+		{"label drain period", map[string]string{AVI_DRAIN_PERIOD_LABEL: "120"}, 5, nil, time.Minute, map[string]bool{"10.0.0.1": true, "10.0.0.2": false}, 1},
+		{"label disables draining", map[string]string{AVI_DRAIN_PERIOD_LABEL: "0"}, 5, nil, 10 * time.Second, map[string]bool{"10.0.0.1": true}, 0},
+		{"invalid label", map[string]string{AVI_DRAIN_PERIOD_LABEL: "soon"}, 5, nil, time.Minute, map[string]bool{"10.0.0.1": true}, 0},
+	} {
+		d := NewDrainer(&AviConfig{drainPeriod: 30}, nil)
+		counter := &fakeCounter{conns: tc.conns, err: tc.err}
+		d.Apply(drainTask(tc.labels, "10.0.0.1", "10.0.0.2"), counter.open)
+
+		// the member goes away and is drained, without looking at its
+		// connections before it was disabled
+		tasks := drainTask(tc.labels, "10.0.0.1")
+		d.Apply(tasks, counter.open)
+		if counter.calls != 0 {
+			t.Errorf("%s: connections counted before the member was disabled", tc.name)
+		}
+
+		backdate(d, tc.age)
+		tasks = drainTask(tc.labels, "10.0.0.1")
+		d.Apply(tasks, counter.open)
+		if got := poolMembers(tasks); !reflect.DeepEqual(got, tc.members) {
+			t.Errorf("%s: members %v, want %v", tc.name, got, tc.members)
+		}
+		if counter.calls != tc.calls {
+			t.Errorf("%s: connections counted %d times, want %d", tc.name, counter.calls, tc.calls)
+		}
+	}
+}
+
+func TestDrainerMemberBack(t *testing.T) {
+	d := NewDrainer(&AviConfig{drainPeriod: 30}, nil)
+	d.Apply(drainTask(nil, "10.0.0.1", "10.0.0.2"), nil)
+	d.Apply(drainTask(nil, "10.0.0.1"), nil)
+	if len(d.draining["web"]) != 1 {
+		t.Fatalf("member not draining: %v", d.draining)
+	}
+
+	tasks := drainTask(nil, "10.0.0.1", "10.0.0.2")
+	d.Apply(tasks, nil)
+	if got := poolMembers(tasks); len(tasks["web"].pools) != 2 || !got["10.0.0.2"] {
+		t.Errorf("member back before it was drained: pools %+v", tasks["web"].pools)
+	}
+	if len(d.draining) != 0 {
+		t.Errorf("member back still draining: %v", d.draining)
+	}
+}
+
+func TestDrainerVSRemoved(t *testing.T) {
+	d := NewDrainer(&AviConfig{drainPeriod: 30}, nil)
+	d.Apply(drainTask(nil, "10.0.0.1", "10.0.0.2"), nil)
+	d.Apply(drainTask(nil, "10.0.0.1"), nil)
+	d.Apply(map[string]*Vservice{}, nil)
+	if len(d.draining) != 0 {
+		t.Errorf("members of a removed VS still draining: %v", d.draining)
+	}
+}
+
+func TestDrainerNotify(t *testing.T) {
+	d := NewDrainer(&AviConfig{drainPeriod: 30}, func(change string) {})
+	d.Apply(drainTask(nil, "10.0.0.1", "10.0.0.2"), nil)
+	if d.timer != nil {
+		t.Errorf("recheck scheduled with nothing draining")
+	}
+	d.Apply(drainTask(nil, "10.0.0.1"), nil)
+	if d.timer == nil {
+		t.Fatalf("no recheck scheduled while draining")
+	}
+	d.timer.Stop()
+}
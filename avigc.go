@@ -0,0 +1,147 @@
+package main
+
+import (
+	"strings"
+)
+
+// gcReferrers are the object types, besides pool groups and pools, whose
+// refs keep an object from being collected.
+var gcReferrers = []string{"virtualservice", "httppolicyset", "vsdatascriptset", "l4policyset"}
+
+// refUuid returns the uuid at the end of an Avi object ref, which may
+// carry a "#name" suffix.
+func refUuid(ref interface{}) string {
+	s, ok := ref.(string)
+	if !ok || s == "" {
+		return ""
+	}
+	s = strings.Split(s, "#")[0]
+	tokens := strings.Split(s, "/")
+	return tokens[len(tokens)-1]
+}
+
+// collectRefs adds the uuids of all objects obj refers to, in any field
+// at any depth, to refs.
+func collectRefs(obj interface{}, refs map[string]bool) {
+	switch v := obj.(type) {
+	case map[string]interface{}:
+		for key, val := range v {
+			if key == "url" {
+				// the object itself
+				continue
+			}
+			collectRefs(val, refs)
+		}
+	case []interface{}:
+		for _, val := range v {
+			collectRefs(val, refs)
+		}
+	case string:
+		if strings.Contains(v, "/api/") {
+			refs[refUuid(v)] = true
+		}
+	}
+}
+
+// objOwned returns true if obj was created by this provider, in its cloud.
+// Health monitors have no cloud and are marked with it in their
+// description instead.
+func (p *Avi) objOwned(obj map[string]interface{}) bool {
+	if obj["created_by"] != CREATED_BY {
+		return false
+	}
+	if _, ok := obj["cloud_ref"]; ok {
+		return refUuid(obj["cloud_ref"]) == refUuid(p.cloudRef)
+	}
+	return obj["description"] == healthMonitorDescription(p.cloudRef)
+}
+
+// GarbageCollect deletes pools, pool groups, VsVips and health monitors
+// owned by Rancher which nothing references any more: no VS, policy set,
+// DataScript set, pool group or pool. Pool groups go first so that the
+// pools they held become unreferenced, then pools, then VsVips and health
+// monitors. Objects are deleted by uuid, so an object created under the
+// same name in the meantime is left alone.
+func (p *Avi) GarbageCollect() {
+	referenced := make(map[string]bool)
+	for _, resource := range gcReferrers {
+		objs, err := p.GetAllObjects(resource, "")
+		if err != nil {
+			return
+		}
+		for _, obj := range objs {
+			collectRefs(obj, referenced)
+		}
+	}
+	pgs, err := p.GetAllObjects("poolgroup", "")
+	if err != nil {
+		return
+	}
+	pools, err := p.GetAllObjects("pool", "")
+	if err != nil {
+		return
+	}
+	vsvips, err := p.GetAllObjects("vsvip", "created_by="+CREATED_BY)
+	if err != nil {
+		return
+	}
+	hms, err := p.GetAllObjects("healthmonitor", "created_by="+CREATED_BY)
+	if err != nil {
+		return
+	}
+
+	orphans := make(map[string]string)
+	missing := []string{}
+	addOrphan := func(kind string, obj map[string]interface{}) {
+		key := kind + "/" + obj["uuid"].(string)
+		orphans[key] = obj["name"].(string)
+		missing = append(missing, key)
+	}
+
+	// pool groups and pools which stay refer to pools and health monitors
+	// still in use
+	for _, pg := range pgs {
+		if !referenced[pg["uuid"].(string)] && p.objOwned(pg) {
+			addOrphan("poolgroup", pg)
+			continue
+		}
+		collectRefs(pg, referenced)
+	}
+	for _, pool := range pools {
+		if !referenced[pool["uuid"].(string)] && p.objOwned(pool) {
+			addOrphan("pool", pool)
+			continue
+		}
+		collectRefs(pool, referenced)
+	}
+	for _, vip := range vsvips {
+		if !referenced[vip["uuid"].(string)] && p.objOwned(vip) {
+			addOrphan("vsvip", vip)
+		}
+	}
+	for _, hm := range hms {
+		if !referenced[hm["uuid"].(string)] && p.objOwned(hm) {
+			addOrphan("healthmonitor", hm)
+		}
+	}
+
+	ready := make(map[string][]string)
+	for _, key := range p.gcGuard.Filter(missing) {
+		kind := strings.Split(key, "/")[0]
+		ready[kind] = append(ready[kind], key)
+	}
+
+	for _, kind := range []string{"poolgroup", "pool", "vsvip", "healthmonitor"} {
+		for _, key := range ready[kind] {
+			name := orphans[key]
+			if p.gcGuard.dryRun {
+				log.Infof("Dry run: would delete orphaned %s %s", kind, name)
+				continue
+			}
+			log.Infof("Deleting orphaned %s %s", kind, name)
+			if res, err := p.aviSession.Delete("/api/" + key); err != nil {
+				log.Errorf("Error deleting orphaned %s %s: %v", kind, name, res)
+			}
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCollectRefs(t *testing.T) {
+	var policy map[string]interface{}
+	err := json.Unmarshal([]byte(`{
+		"url": "https://avi/api/httppolicyset/httppolicyset-1#policy",
+		"uuid": "httppolicyset-1",
+		"tenant_ref": "https://avi/api/tenant/admin",
+		"http_request_policy": {"rules": [
+			{"switching_action": {"pool_group_ref": "https://avi/api/poolgroup/poolgroup-1#web-poolgroup"}},
+			{"switching_action": {"pool_ref": "/api/pool/pool-1"}}
+		]}
+	}`), &policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs := make(map[string]bool)
+	collectRefs(policy, refs)
+	for _, uuid := range []string{"poolgroup-1", "pool-1", "admin"} {
+		if !refs[uuid] {
+			t.Errorf("ref to %s not found in %v", uuid, refs)
+		}
+	}
+	if refs["httppolicyset-1"] {
+		t.Errorf("object refers to itself")
+	}
+}
+
+func TestObjOwned(t *testing.T) {
+	p := &Avi{cloudRef: "https://avi/api/cloud/cloud-1"}
+	for _, tc := range []struct {
+		obj   map[string]interface{}
+		owned bool
+	}{
+		{map[string]interface{}{"created_by": CREATED_BY, "cloud_ref": "https://avi/api/cloud/cloud-1#Default-Cloud"}, true},
+		{map[string]interface{}{"created_by": CREATED_BY, "cloud_ref": "https://avi/api/cloud/cloud-2"}, false},
+		{map[string]interface{}{"cloud_ref": "https://avi/api/cloud/cloud-1", "name": "web-pool-80-tcp"}, false},
+		{map[string]interface{}{"created_by": CREATED_BY, "description": healthMonitorDescription(p.cloudRef)}, true},
+		{map[string]interface{}{"created_by": CREATED_BY, "description": healthMonitorDescription("/api/cloud/cloud-2")}, false},
+		{map[string]interface{}{"created_by": CREATED_BY}, false},
+	} {
+		if owned := p.objOwned(tc.obj); owned != tc.owned {
+			t.Errorf("objOwned(%v) = %v, want %v", tc.obj, owned, tc.owned)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// healthCheck is a Rancher service health check. Times are in
+// milliseconds, the port is on the container side.
+type healthCheck struct {
+	Port               int    `json:"port"`
+	RequestLine        string `json:"request_line,omitempty"`
+	Interval           int    `json:"interval"`
+	ResponseTimeout    int    `json:"response_timeout"`
+	HealthyThreshold   int    `json:"healthy_threshold"`
+	UnhealthyThreshold int    `json:"unhealthy_threshold"`
+}
+
+// rancherHealthCheck returns the health check of a service, or nil if it
+// has none.
+func rancherHealthCheck(hc metadata.HealthCheck) *healthCheck {
+	if hc.Port == 0 {
+		return nil
+	}
+	return &healthCheck{
+		Port:               hc.Port,
+		RequestLine:        hc.RequestLine,
+		Interval:           hc.Interval,
+		ResponseTimeout:    hc.ResponseTimeout,
+		HealthyThreshold:   hc.HealthyThreshold,
+		UnhealthyThreshold: hc.UnhealthyThreshold,
+	}
+}
+
+// httpRequest turns a Rancher request line like `GET "/ping" "HTTP/1.0"`
+// into an HTTP request line.
+func (hc *healthCheck) httpRequest() string {
+	fields := strings.Fields(hc.RequestLine)
+	for i := range fields {
+		fields[i] = strings.Trim(fields[i], `"`)
+	}
+	switch len(fields) {
+	case 0:
+		return "GET / HTTP/1.0"
+	case 1:
+		return fmt.Sprintf("GET %s HTTP/1.0", fields[0])
+	case 2:
+		return fmt.Sprintf("%s %s HTTP/1.0", fields[0], fields[1])
+	}
+	return strings.Join(fields, " ")
+}
+
+// secondsOf converts milliseconds to whole seconds, rounding up, never
+// less than min.
+func secondsOf(ms int, min int) int {
+	s := (ms + 999) / 1000
+	if s < min {
+		return min
+	}
+	return s
+}
+
+// monitorPort returns the port members are checked on: the front port
+// mapped to the health check port. ok is false if the health check port
+// isn't reachable, or not on the same port for every member.
+func monitorPort(task *Vservice) (int, bool) {
+	port := 0
+	for _, pl := range task.pools {
+		for front, back := range pl.ports {
+			if back != task.healthCheck.Port {
+				continue
+			}
+			if port != 0 && port != front {
+				return 0, false
+			}
+			port = front
+		}
+	}
+	return port, port != 0
+}
+
+// healthMonitorDescription marks health monitors with the provider's
+// cloud, as they carry no cloud_ref to tell the providers of several
+// clouds apart.
+func healthMonitorDescription(cloudRef string) string {
+	return "Created by " + CREATED_BY + " for cloud " + refUuid(cloudRef)
+}
+
+// configure_healthmonitor builds the Avi HealthMonitor for the service's
+// health check.
+func (p *Avi) configure_healthmonitor(task *Vservice, port int) map[string]interface{} {
+	hc := task.healthCheck
+	hm := make(map[string]interface{})
+	hm["name"] = p.cfg.namer.HealthMonitorName(task.names)
+	hm["tenant_ref"], _ = p.aviSession.GetTenantRef(p.cfg.tenant)
+	hm["created_by"] = CREATED_BY
+	hm["description"] = healthMonitorDescription(p.cloudRef)
+	hm["monitor_port"] = port
+
+	timeout := secondsOf(hc.ResponseTimeout, 1)
+	interval := secondsOf(hc.Interval, 1)
+	if interval <= timeout {
+		// Avi wants the timeout shorter than the interval
+		interval = timeout + 1
+	}
+	hm["send_interval"] = interval
+	hm["receive_timeout"] = timeout
+	if hc.HealthyThreshold > 0 {
+		hm["successful_checks"] = hc.HealthyThreshold
+	}
+	if hc.UnhealthyThreshold > 0 {
+		hm["failed_checks"] = hc.UnhealthyThreshold
+	}
+
+	if hc.RequestLine == "" {
+		hm["type"] = "HEALTH_MONITOR_TCP"
+		return hm
+	}
+	http := make(map[string]interface{})
+	http["http_request"] = hc.httpRequest()
+	// like Rancher, any 2xx or 3xx response is healthy
+	http["http_response_code"] = []string{"HTTP_2XX", "HTTP_3XX"}
+	if hc.Port == 443 {
+		hm["type"] = "HEALTH_MONITOR_HTTPS"
+		hm["https_monitor"] = http
+	} else {
+		hm["type"] = "HEALTH_MONITOR_HTTP"
+		hm["http_monitor"] = http
+	}
+	return hm
+}
+
+// EnsureHealthMonitor creates or updates the HealthMonitor for the
+// service's health check and returns its ref. ok is false if the service
+// has no usable health check, in which case the system monitors apply.
+func (p *Avi) EnsureHealthMonitor(task *Vservice) (string, bool) {
+	if task.healthCheck == nil {
+		return "", false
+	}
+	port, ok := monitorPort(task)
+	if !ok {
+		log.Warnf("Health check port %d of VS %s is not published on one port, using system health monitors",
+			task.healthCheck.Port, task.serviceName)
+		return "", false
+	}
+	hm := p.configure_healthmonitor(task, port)
+	name := hm["name"].(string)
+
+	res, err := p.aviSession.GetCollection("/api/healthmonitor?name=" + name)
+	if err != nil {
+		log.Errorf("Error looking up health monitor %s: %v", name, err)
+		return "", false
+	}
+	var resp interface{}
+	if res.Count == 0 {
+		resp, err = p.aviSession.Post("/api/healthmonitor", hm)
+	} else {
+		var existing map[string]interface{}
+		if err = json.Unmarshal(res.Results[0], &existing); err != nil {
+			log.Errorf("Health monitor %s unmarshal failed: %v", name, err)
+			return "", false
+		}
+		if existing["created_by"] != CREATED_BY {
+			log.Errorf("Health monitor %s exists and is not owned by Rancher, using system health monitors", name)
+			return "", false
+		}
+		hm["uuid"] = existing["uuid"]
+		resp, err = p.aviSession.Put("/api/healthmonitor/"+existing["uuid"].(string), hm)
+	}
+	if err != nil {
+		log.Errorf("Error in creating/updating health monitor %s: %v", name, resp)
+		return "", false
+	}
+	obj, _ := resp.(map[string]interface{})
+	uuid, _ := obj["uuid"].(string)
+	if uuid == "" {
+		return "/api/healthmonitor?name=" + name, true
+	}
+	return "/api/healthmonitor/" + uuid, true
+}
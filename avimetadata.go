@@ -2,12 +2,14 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"sort"
+	"strconv"
 	"time"
 	"strings"
-	"strconv"
 	"encoding/json"
 
-	"github.com/Sirupsen/logrus"
+	"github.com/sirupsen/logrus"
 	"github.com/rancher/go-rancher-metadata/metadata"
 )
 
@@ -28,21 +30,100 @@ func getEnvironmentUUID(m metadata.Client) (string, error) {
 	return "", fmt.Errorf("Error reading stack info: %v", err)
 }
 
-func getEnvironmentName(m metadata.Client) (string, error) {
-	timeout := 30 * time.Second
-	var err error
-	var stack metadata.Stack
-	for i := 1 * time.Second; i < timeout; i *= time.Duration(2) {
+// stackCache holds the agent's own stack, which carries the environment
+// info, for as long as the metadata version stays the same.
+type stackCache struct {
+	version string
+	stack   metadata.Stack
+	valid   bool
+}
+
+var selfStack = &stackCache{}
+
+// Get returns the agent's stack, fetching it only when the metadata
+// version changed. If metadata can't be read the last known stack is
+// returned rather than waiting for metadata to come back.
+func (c *stackCache) Get(m metadata.Client) (metadata.Stack, error) {
+	version, err := m.GetVersion()
+	if err == nil && c.valid && version == c.version {
+		return c.stack, nil
+	}
+	if err == nil {
+		var stack metadata.Stack
 		stack, err = m.GetSelfStack()
-		if err != nil {
-			logrus.Errorf("Error reading stack info: %v...will retry", err)
-			time.Sleep(i)
-		} else {
-			return stack.EnvironmentName, nil
+		if err == nil {
+			c.version = version
+			c.stack = stack
+			c.valid = true
+			return stack, nil
 		}
 	}
+	if c.valid {
+		log.Warnf("Error reading stack info, using cached info: %v", err)
+		return c.stack, nil
+	}
+	return c.stack, fmt.Errorf("Error reading stack info: %v", err)
+}
 
-	return "", fmt.Errorf("Error reading stack info: %v", err)
+// getHosts returns the hosts of the environment by UUID.
+func getHosts(m metadata.Client) (map[string]metadata.Host, error) {
+	hosts := make(map[string]metadata.Host)
+	hostList, err := m.GetHosts()
+	if err != nil {
+		return hosts, err
+	}
+	for _, host := range hostList {
+		hosts[host.UUID] = host
+	}
+	return hosts, nil
+}
+
+const (
+	DEFAULT_MAINTENANCE_LABEL = "avi_maintenance"
+)
+
+// hostInMaintenance returns true if Rancher doesn't have the host active,
+// for example while it is evacuated, or if it carries the maintenance
+// label.
+func hostInMaintenance(host metadata.Host, label string) bool {
+	if host.State != "" && host.State != "active" {
+		return true
+	}
+	return labelEnabled(host.Labels, label)
+}
+
+// maintenanceHosts remembers which hosts are in maintenance so that changes can
+// be logged.
+var maintenanceHosts = make(map[string]bool)
+
+func observeMaintenance(hosts map[string]metadata.Host, label string) {
+	for uuid, host := range hosts {
+		maint := hostInMaintenance(host, label)
+		if maint != maintenanceHosts[uuid] {
+			if maint {
+				log.Infof("Host %s (%s) in maintenance, disabling its pool members", host.Name, host.State)
+			} else {
+				log.Infof("Host %s back from maintenance, enabling its pool members", host.Name)
+			}
+		}
+		maintenanceHosts[uuid] = maint
+	}
+	for uuid := range maintenanceHosts {
+		if _, ok := hosts[uuid]; !ok {
+			delete(maintenanceHosts, uuid)
+		}
+	}
+}
+
+// hostAddress returns the IP to reach ports published on all interfaces of
+// the host: the value of the given host label if set, else the agent IP.
+func hostAddress(host metadata.Host, label string) string {
+	if label != "" {
+		if ip, ok := host.Labels[label]; ok && ip != "" {
+			return ip
+		}
+	}
+	return host.AgentIP
 }
 
 func GetMetadataServiceConfigs(m metadata.Client, cfg *AviConfig) (map[string]*Vservice, error) {
@@ -52,86 +133,262 @@ func GetMetadataServiceConfigs(m metadata.Client, cfg *AviConfig) (map[string]*V
                 log.Infof("Error reading services: %v", err)
 		return Vservices, err
         }
+	hosts, err := getHosts(m)
+	if err != nil {
+		log.Infof("Error reading hosts: %v", err)
+		return Vservices, err
+	}
+	self, err := selfStack.Get(m)
+	if err != nil {
+		log.Infof("Error reading stack info: %v", err)
+		return Vservices, err
+	}
+	observeMaintenance(hosts, cfg.maintenanceLabel)
+	localZone := cfg.localZone
+	if localZone == "" && cfg.zoneLabel != "" {
+		if host, err := m.GetSelfHost(); err == nil {
+			localZone = host.Labels[cfg.zoneLabel]
+		} else {
+			log.Warnf("Error reading own host, no zone preferred: %v", err)
+		}
+	}
+	byName := make(map[string]metadata.Service)
+	for _, service := range services {
+		byName[service.StackName+"/"+service.Name] = service
+	}
 	for _, service := range services {
 		pools := []pool{}
 		var serviceName string
+		var names nameData
 		label_sname := ""
 		labels := make(map[string]string)
-		_, ok := service.Labels[AVI_INTEGRATION_LABEL]
-		if ok {
-			continue
-		}
-		if val, ok := service.Labels[AVI_PROXY_LABEL]; ok {
-			var result map[string]interface{}
-			arr := []byte(val)
-			err := json.Unmarshal(arr, &result)
-			if err == nil {
-				_, ok := result["virtualservice"]
-				if ok {
-					val, ok := result["virtualservice"].(map[string]interface{})["name"]
-					if ok {
-						label_sname = val.(string)
-					}
-				}
-			}
+		if !cfg.filter.Allows(service, self.Name) {
+			continue
 		}
+		if !serviceDiscovered(service.Labels, cfg) {
+			continue
+		}
+		label_sname = labelVSName(service.Labels)
 		for label, val := range service.Labels {
 			labels[label] = val
 		}
-		for _, container := range service.Containers {
-			if len(container.ServiceName) == 0 {
-				continue
-			}
-			if len(container.Ports) == 0 {
+		backendMode := labelBackendMode(labels, cfg.backendMode, service.StackName+"/"+service.Name)
+		names = nameData{
+			Environment: self.EnvironmentName,
+			Stack:       service.StackName,
+			Service:     service.Name,
+			Subdomain:   cfg.dnsSubDomain,
+		}
+		if label_sname == "" {
+			serviceName = cfg.namer.VSName(names)
+		} else {
+			serviceName = label_sname
+		}
+		names.VS = serviceName
+		for _, member := range serviceMembers(service, byName, hosts, backendMode, cfg, 0) {
+			port := member.frontPort()
+			if memberExists(Vservices, serviceName, member.hostip, port) {
 				continue
 			}
-			for _, port := range container.Ports {
-				portspec := strings.Split(port, ":")
-				if len(portspec) != 3 {
-					log.Warnf("Unexpected format of port spec for container %s: %s", container.Name, port)
-					continue
-				}
-				hostip := portspec[0]
-				hostport, err := strconv.Atoi(portspec[1])
-				if err != nil {
-					log.Warnf("Unexpected format of Host port for container %s: %s", container.Name, port)
-					continue
-				}
-				if hostip == "0.0.0.0" {
-					log.Warnf("Unexpected format of Host IP for container %s: %s", container.Name, hostip)
-					continue
-				}
-				protospec := strings.Split(portspec[2], "/")
-				if len(protospec) != 2 {
-					log.Warnf("Unexpected format of proto spec for container %s: %s", container.Name, port)
-					continue
-				}
-				contport, err := strconv.Atoi(protospec[0])
-				if err != nil {
-					log.Warnf("Unexpected format of Container port for container %s: %s", container.Name, port)
+			poolnames := names
+			poolnames.Port = port
+			poolnames.Protocol = member.protocol
+			member.poolName = cfg.namer.PoolName(poolnames)
+			pools = append(pools, member)
+		}
+		if len(pools) > 0 {
+			owner := fmt.Sprintf("%s/%s", service.StackName, service.Name)
+			if existing, ok := Vservices[serviceName]; ok {
+				if splitEnabled(existing.labels) && splitEnabled(labels) {
+					log.Infof("Services %s and %s share VS %s", existing.owner, owner, serviceName)
+					existing.addSplit(owner, labels, pools)
 					continue
 				}
-				proto := protospec[1]
-				envname, _ := getEnvironmentName(m)
-				if label_sname == "" {
-					serviceName = fmt.Sprintf("%s-%s-%s", envname, service.StackName, service.Name)
-				} else {
-					serviceName = label_sname
-				}
-				s, ok := Vservices[serviceName]
-				found := false
-				if ok {
-					for _, val := range s.pools {
-						if val.hostip == hostip {
-							if _, ok := val.ports[hostport]; ok {
-								found = true
-							}
-						}
+				log.Errorf("Services %s and %s both claim VS %s", existing.owner, owner, serviceName)
+				existing.conflicts = append(existing.conflicts, owner)
+				continue
+			}
+			dt := Vservice{}
+			dt.serviceName = serviceName
+			dt.labels = labels
+			if splitEnabled(labels) {
+				dt.addSplit(owner, labels, pools)
+			} else {
+				dt.pools = pools
+			}
+			dt.owner = owner
+			dt.names = names
+			dt.backendMode = backendMode
+			dt.vipType = labelVipType(labels, cfg.vipType, owner)
+			dt.healthCheck = rancherHealthCheck(service.HealthCheck)
+			if cfg.zoneLabel != "" {
+				dt.localZone = localZone
+			}
+			if label_sname == "" {
+				dt.legacyName = LegacyVSName(names)
+			}
+			Vservices[dt.serviceName] = &dt
+			log.Info(Vservices[dt.serviceName])
+		}
+	}
+	memberStates.Prune()
+	return Vservices, err
+}
+
+// labelVSName returns the VS name set in the avi_proxy label, if any.
+func labelVSName(labels map[string]string) string {
+	val, ok := labels[AVI_PROXY_LABEL]
+	if !ok {
+		return ""
+	}
+	var result map[string]interface{}
+	if err := json.Unmarshal([]byte(val), &result); err != nil {
+		return ""
+	}
+	vs, ok := result["virtualservice"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	name, _ := vs["name"].(string)
+	return name
+}
+
+// labelBackendMode returns the backend mode of the avi_backend_mode
+// label, or def if the label is not set or not a valid mode.
+func labelBackendMode(labels map[string]string, def string, service string) string {
+	val, ok := labels[AVI_BACKEND_MODE_LABEL]
+	if !ok {
+		return def
+	}
+	if !validBackendMode(val) {
+		log.Warnf("Invalid %s label %s on service %s, using %s", AVI_BACKEND_MODE_LABEL, val, service, def)
+		return def
+	}
+	return val
+}
+
+func validBackendMode(mode string) bool {
+	return mode == BACKEND_MODE_HOSTPORT || mode == BACKEND_MODE_CONTAINER
+}
+
+func validVipType(vipType string) bool {
+	switch vipType {
+	case VIP_TYPE_V4, VIP_TYPE_V6, VIP_TYPE_DUAL:
+		return true
+	}
+	return false
+}
+
+// labelVipType returns the VIP type of the avi_vip_type label, or def if
+// the label is not set or not a valid type.
+func labelVipType(labels map[string]string, def string, service string) string {
+	val, ok := labels[AVI_VIP_TYPE_LABEL]
+	if !ok {
+		return def
+	}
+	if !validVipType(val) {
+		log.Warnf("Invalid %s label %s on service %s, using %s", AVI_VIP_TYPE_LABEL, val, service, def)
+		return def
+	}
+	return val
+}
+
+// maxAliasDepth bounds how deep aliases of aliases are followed.
+const maxAliasDepth = 5
+
+// serviceMembers returns the pool members of a service, without pool
+// names: the published ports of its containers, the external IPs or
+// hostname of an external service, or the members of the targets of an
+// alias.
+func serviceMembers(service metadata.Service, byName map[string]metadata.Service,
+	hosts map[string]metadata.Host, backendMode string, cfg *AviConfig, depth int) []pool {
+	switch service.Kind {
+	case SERVICE_KIND_EXTERNAL:
+		return externalMembers(service)
+	case SERVICE_KIND_ALIAS:
+		if depth >= maxAliasDepth {
+			log.Warnf("Aliases nested too deep at %s/%s", service.StackName, service.Name)
+			return []pool{}
+		}
+		pools := []pool{}
+		for link := range service.Links {
+			key := link
+			if !strings.Contains(key, "/") {
+				key = service.StackName + "/" + key
+			}
+			target, ok := byName[key]
+			if !ok {
+				log.Warnf("Target %s of alias %s/%s not found", link, service.StackName, service.Name)
+				continue
+			}
+			pools = append(pools, serviceMembers(target, byName, hosts, backendMode, cfg, depth+1)...)
+		}
+		return pools
+	}
+	return containerMembers(service, hosts, backendMode, cfg)
+}
+
+// containerMembers returns the pool members of a service's containers.
+func containerMembers(service metadata.Service, hosts map[string]metadata.Host,
+	backendMode string, cfg *AviConfig) []pool {
+	pools := []pool{}
+	labels := service.Labels
+	healthPolicy := labels[AVI_HEALTH_POLICY_LABEL]
+	for _, container := range service.Containers {
+		if len(container.ServiceName) == 0 {
+			continue
+		}
+		if len(container.Ports) == 0 && backendMode != BACKEND_MODE_CONTAINER {
+			continue
+		}
+		enabled, member := memberState(container, healthPolicy)
+		if host, ok := hosts[container.HostUUID]; ok && hostInMaintenance(host, cfg.maintenanceLabel) {
+			enabled = false
+		}
+		memberStates.Observe(container, enabled, member)
+		if !member {
+			continue
+		}
+		zone := ""
+		if cfg.zoneLabel != "" {
+			zone = hosts[container.HostUUID].Labels[cfg.zoneLabel]
+		}
+		ratio := containerRatio(container, hosts[container.HostUUID].Labels, labels)
+		if backendMode == BACKEND_MODE_CONTAINER {
+			if container.PrimaryIp == "" {
+				log.Warnf("No IP address known for container %s", container.Name)
+				continue
+			}
+			for _, cp := range containerPorts(container, labels[AVI_CONTAINER_PORTS_LABEL]) {
+				poolmem := pool{}
+				poolmem.hostip = container.PrimaryIp
+				poolmem.ports = map[int]int{cp.port: cp.port}
+				poolmem.protocol = cp.protocol
+				poolmem.enabled = enabled
+				poolmem.zone = zone
+				poolmem.ratio = ratio
+				pools = append(pools, poolmem)
+			}
+			continue
+		}
+		for _, port := range container.Ports {
+			bindings, err := parsePortSpec(port)
+			if err != nil {
+				log.Warnf("Unexpected format of port spec for container %s: %v", container.Name, err)
+				continue
+			}
+			for _, b := range bindings {
+				hostip := b.hostIP
+				if hostip == "" || isAnyAddr(hostip) {
+					hostip = hostAddress(hosts[container.HostUUID], cfg.hostIPLabel)
+					if hostip == "" {
+						log.Warnf("No IP address known for host %s of container %s", container.HostUUID, container.Name)
+						continue
 					}
 				}
-				if found {
-					continue
-				}
+				hostport := b.hostPort
+				contport := b.containerPort
+				proto := b.protocol
 				poolmem := pool{}
 				poolmem.hostip = hostip
 
@@ -140,20 +397,193 @@ func GetMetadataServiceConfigs(m metadata.Client, cfg *AviConfig) (map[string]*V
 
 				poolmem.ports = ports
 				poolmem.protocol = proto
-				poolmem.poolName = fmt.Sprintf("%s-pool-%d-%s", serviceName, hostport, proto)
+				poolmem.enabled = enabled
+				poolmem.zone = zone
+				poolmem.ratio = ratio
 				pools = append(pools, poolmem)
 			}
 		}
-		if len(pools) > 0 {
-			dt := Vservice{}
-			dt.serviceName = serviceName
-			dt.labels = labels
-			dt.pools = pools
-			Vservices[dt.serviceName] = &dt
-			log.Info(Vservices[dt.serviceName])
+	}
+	return pools
+}
+
+// serverRatio returns the ratio of a container's pool servers from the
+// avi_server_ratio label of the container, else of its host, else of its
+// service. 0 leaves the ratio to Avi.
+func serverRatio(name string, labelSets ...map[string]string) int {
+	for _, labels := range labelSets {
+		val, ok := labels[AVI_SERVER_RATIO_LABEL]
+		if !ok {
+			continue
 		}
+		ratio, err := strconv.Atoi(val)
+		if err != nil || ratio < MIN_SERVER_RATIO || ratio > MAX_SERVER_RATIO {
+			log.Warnf("Invalid %s label %s for container %s", AVI_SERVER_RATIO_LABEL, val, name)
+			continue
+		}
+		return ratio
 	}
-	return Vservices, err
+	return 0
+}
+
+// containerRatio returns the server ratio of a Rancher container. Cattle
+// copies service labels onto containers, so a container label equal to
+// the service's is inherited and does not override the host label.
+func containerRatio(container metadata.Container, hostLabels map[string]string, serviceLabels map[string]string) int {
+	containerLabels := container.Labels
+	val, ok := containerLabels[AVI_SERVER_RATIO_LABEL]
+	if svcVal, svcOk := serviceLabels[AVI_SERVER_RATIO_LABEL]; ok && svcOk && val == svcVal {
+		containerLabels = nil
+	}
+	return serverRatio(container.Name, containerLabels, hostLabels, serviceLabels)
+}
+
+// externalMembers returns the pool members of an external service: its
+// external IPs, or the addresses its hostname resolves to, on the ports
+// of the avi_external_ports label.
+func externalMembers(service metadata.Service) []pool {
+	pools := []pool{}
+	ports := parseContainerPorts(service.Name, service.Labels[AVI_EXTERNAL_PORTS_LABEL])
+	if len(ports) == 0 {
+		log.Warnf("No %s label on external service %s/%s", AVI_EXTERNAL_PORTS_LABEL,
+			service.StackName, service.Name)
+		return pools
+	}
+	ips := service.ExternalIps
+	if len(ips) == 0 && service.Hostname != "" {
+		ips = resolver.Lookup(service.Hostname)
+	}
+	for _, ip := range ips {
+		for _, cp := range ports {
+			poolmem := pool{}
+			poolmem.hostip = ip
+			poolmem.ports = map[int]int{cp.port: cp.port}
+			poolmem.protocol = cp.protocol
+			poolmem.enabled = true
+			pools = append(pools, poolmem)
+		}
+	}
+	return pools
+}
+
+// hostResolver resolves the hostnames of external services, remembering
+// the last addresses so that a DNS outage doesn't empty the pools.
+type hostResolver struct {
+	last map[string][]string
+}
+
+var resolver = &hostResolver{last: make(map[string][]string)}
+
+func (r *hostResolver) Lookup(hostname string) []string {
+	addrs, err := net.LookupIP(hostname)
+	if err != nil {
+		if ips, ok := r.last[hostname]; ok {
+			log.Warnf("Error resolving %s, using last known addresses: %v", hostname, err)
+			return ips
+		}
+		log.Warnf("Error resolving %s: %v", hostname, err)
+		return []string{}
+	}
+	ips := []string{}
+	for _, addr := range addrs {
+		ips = append(ips, addr.String())
+	}
+	sort.Strings(ips)
+	r.last[hostname] = ips
+	return ips
+}
+
+// frontPort returns the port Avi sends traffic to, members having only
+// one.
+func (pl pool) frontPort() int {
+	for port := range pl.ports {
+		return port
+	}
+	return 0
+}
+
+// memberExists returns true if the VS already has a member ip:port from
+// another service.
+func memberExists(Vservices map[string]*Vservice, serviceName string, ip string, port int) bool {
+	s, ok := Vservices[serviceName]
+	if !ok {
+		return false
+	}
+	for _, val := range s.pools {
+		if val.hostip == ip {
+			if _, ok := val.ports[port]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type containerPort struct {
+	port     int
+	protocol string
+}
+
+// containerPorts returns the container side of the published ports plus
+// the ports listed in the avi_container_ports label, like
+// "8080/tcp,53/udp,9000-9009".
+func containerPorts(container metadata.Container, extra string) []containerPort {
+	ports := []containerPort{}
+	seen := make(map[containerPort]bool)
+	add := func(cp containerPort) {
+		if !seen[cp] {
+			seen[cp] = true
+			ports = append(ports, cp)
+		}
+	}
+
+	for _, port := range container.Ports {
+		bindings, err := parsePortSpec(port)
+		if err != nil {
+			log.Warnf("Unexpected format of port spec for container %s: %v", container.Name, err)
+			continue
+		}
+		for _, b := range bindings {
+			add(containerPort{b.containerPort, b.protocol})
+		}
+	}
+
+	for _, cp := range parseContainerPorts(container.Name, extra) {
+		add(cp)
+	}
+	return ports
+}
+
+// parseContainerPorts parses a list of container ports like
+// "8080/tcp,53/udp,9000-9009".
+func parseContainerPorts(name string, list string) []containerPort {
+	ports := []containerPort{}
+	if list == "" {
+		return ports
+	}
+	for _, spec := range strings.Split(list, ",") {
+		portspec := strings.SplitN(strings.TrimSpace(spec), "/", 2)
+		protoSpec := "tcp"
+		if len(portspec) == 2 {
+			protoSpec = portspec[1]
+		}
+		protos, err := parseProtocols(protoSpec)
+		if err != nil {
+			log.Warnf("Unexpected format of Container port for container %s: %s", name, spec)
+			continue
+		}
+		first, last, err := parsePortRange(portspec[0])
+		if err != nil {
+			log.Warnf("Unexpected format of Container port for container %s: %s", name, spec)
+			continue
+		}
+		for port := first; port <= last; port++ {
+			for _, proto := range protos {
+				ports = append(ports, containerPort{port, proto})
+			}
+		}
+	}
+	return ports
 }
 
 func containerStateOK(container metadata.Container) bool {
@@ -174,15 +604,101 @@ func containerStateOK(container metadata.Container) bool {
 	return true
 }
 
+// memberState decides whether a container is a pool member and whether
+// that member is enabled. Only running containers are members; running
+// containers which are not healthy are handled as the service's health
+// policy says.
+func memberState(container metadata.Container, policy string) (bool, bool) {
+	if containerStateOK(container) {
+		return true, true
+	}
+	if container.State != "running" {
+		return false, false
+	}
+	switch policy {
+	case HEALTH_POLICY_REMOVE:
+		return false, false
+	case HEALTH_POLICY_IGNORE:
+		return true, true
+	}
+	return false, true
+}
+
+// containerStates remembers the member state of every container so that
+// changes can be logged.
+type containerStates struct {
+	states map[string]string
+	seen   map[string]bool
+}
+
+var memberStates = &containerStates{
+	states: make(map[string]string),
+	seen:   make(map[string]bool),
+}
+
+func (cs *containerStates) Observe(container metadata.Container, enabled bool, member bool) {
+	state := "removed"
+	if member && enabled {
+		state = "enabled"
+	} else if member {
+		state = "disabled"
+	}
+	cs.seen[container.UUID] = true
+	old, ok := cs.states[container.UUID]
+	if ok && old != state {
+		log.Infof("Container %s (%s/%s) pool member %s -> %s",
+			container.Name, container.State, container.HealthState, old, state)
+	} else if !ok && state != "enabled" {
+		log.Infof("Container %s (%s/%s) pool member %s",
+			container.Name, container.State, container.HealthState, state)
+	}
+	cs.states[container.UUID] = state
+}
+
+// Prune forgets containers which were not observed since the last Prune.
+func (cs *containerStates) Prune() {
+	for uuid := range cs.states {
+		if !cs.seen[uuid] {
+			delete(cs.states, uuid)
+		}
+	}
+	cs.seen = make(map[string]bool)
+}
+
+// parse_docker_tasks creates and updates VSes for tasks, and deletes the
+// VSes which are no longer in tasks once the delete guard lets it.
 func parse_docker_tasks(p *Avi, tasks map[string]*Vservice) {
+	p.collisions.Reset()
 	for _, dt := range tasks {
+		if len(dt.conflicts) > 0 {
+			// leave the VS alone until only one service claims it
+			p.collisions.Report(dt.owner, ErrDuplicateVS(dt.serviceName))
+			for _, owner := range dt.conflicts {
+				p.collisions.Report(owner, ErrDuplicateVS(dt.serviceName))
+			}
+			continue
+		}
 		vs, err := p.GetVS(dt.serviceName)
 		if err != nil {
-			p.CreateUpdateVS(dt, true, nil)
+			if old, ok := p.legacyVS(dt, tasks); ok {
+				log.Infof("Renaming VS %s to %s", old["name"], dt.serviceName)
+				p.CreateUpdateVS(dt, false, old)
+			} else {
+				p.CreateUpdateVS(dt, true, nil)
+			}
+		} else if !VsOwned(vs) {
+			if !labelEnabled(dt.labels, AVI_ADOPT_LABEL) {
+				p.collisions.Report(dt.serviceName, ErrDuplicateVS(dt.serviceName))
+				continue
+			}
+			p.AdoptVS(dt, vs)
+		} else if _, adopted := VsAdoption(vs); adopted && !labelEnabled(dt.labels, AVI_ADOPT_LABEL) {
+			// adoption label removed, hand the VS back
+			p.ReleaseVS(vs)
 		} else {
-			check_sum := fmt.Sprintf("%x", CalculateChecksum(dt))
+			check_sum := fmt.Sprintf("%x", CalculateChecksum(dt, p.cfg))
 			if check_sum != vs["cloud_config_cksum"] {
-				log.Infof("Checksum changed", check_sum, vs["cloud_config_cksum"])
+				log.Infof("Checksum changed %s -> %s", vs["cloud_config_cksum"], check_sum)
 				p.CreateUpdateVS(dt, false, vs)
 			}
 		}
@@ -192,10 +708,49 @@ func parse_docker_tasks(p *Avi, tasks map[string]*Vservice) {
 		log.Info("Failed in fetching all VSes: err", err)
 		return
 	}
+	stale := make(map[string]map[string]interface{})
+	missing := []string{}
 	for _, vs := range vses {
 		vs_name := vs["name"].(string)
-		if _, ok := tasks[vs_name]; !ok {
-			p.DeleteVS(vs)
+		if _, ok := tasks[vs_name]; ok {
+			continue
 		}
+		if VsIsProtected(vs) {
+			log.Infof("VS %s is protected, not deleting", vs_name)
+			continue
+		}
+		stale[vs_name] = vs
+		missing = append(missing, vs_name)
+	}
+	ready := p.deleteGuard.Filter(missing)
+	if !p.deleteGuard.Allow(ready, len(vses)) {
+		return
+	}
+	for _, vs_name := range ready {
+		if p.deleteGuard.dryRun {
+			log.Infof("Dry run: would delete VS %s", vs_name)
+			continue
+		}
+		if _, adopted := VsAdoption(stale[vs_name]); adopted {
+			p.ReleaseVS(stale[vs_name])
+			continue
+		}
+		p.DeleteVS(stale[vs_name])
+	}
+}
+
+// legacyVS returns the VS created for the service under its pre-template
+// name, if it still needs to be renamed.
+func (p *Avi) legacyVS(dt *Vservice, tasks map[string]*Vservice) (map[string]interface{}, bool) {
+	if dt.legacyName == "" || dt.legacyName == dt.serviceName {
+		return nil, false
+	}
+	if _, taken := tasks[dt.legacyName]; taken {
+		return nil, false
+	}
+	vs, err := p.GetVS(dt.legacyName)
+	if err != nil || !VsOwned(vs) {
+		return nil, false
 	}
+	return vs, true
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func TestContainerRatio(t *testing.T) {
+	for _, tc := range []struct {
+		desc      string
+		container map[string]string
+		host      map[string]string
+		service   map[string]string
+		want      int
+	}{
+		{"none", nil, nil, nil, 0},
+		{"service", map[string]string{AVI_SERVER_RATIO_LABEL: "2"}, nil,
+			map[string]string{AVI_SERVER_RATIO_LABEL: "2"}, 2},
+		{"host over inherited service label", map[string]string{AVI_SERVER_RATIO_LABEL: "2"},
+			map[string]string{AVI_SERVER_RATIO_LABEL: "5"},
+			map[string]string{AVI_SERVER_RATIO_LABEL: "2"}, 5},
+		{"container over host", map[string]string{AVI_SERVER_RATIO_LABEL: "8"},
+			map[string]string{AVI_SERVER_RATIO_LABEL: "5"},
+			map[string]string{AVI_SERVER_RATIO_LABEL: "2"}, 8},
+		{"container without service label", map[string]string{AVI_SERVER_RATIO_LABEL: "3"},
+			map[string]string{AVI_SERVER_RATIO_LABEL: "5"}, nil, 3},
+		{"host", nil, map[string]string{AVI_SERVER_RATIO_LABEL: "5"}, nil, 5},
+		{"invalid host", nil, map[string]string{AVI_SERVER_RATIO_LABEL: "50"},
+			map[string]string{AVI_SERVER_RATIO_LABEL: "2"}, 2},
+	} {
+		container := metadata.Container{Name: "web-1", Labels: tc.container}
+		if got := containerRatio(container, tc.host, tc.service); got != tc.want {
+			t.Errorf("%s: ratio %d, want %d", tc.desc, got, tc.want)
+		}
+	}
+}
+
+func TestLabelVipType(t *testing.T) {
+	for _, tc := range []struct {
+		labels map[string]string
+		want   string
+	}{
+		{nil, VIP_TYPE_V4},
+		{map[string]string{AVI_VIP_TYPE_LABEL: VIP_TYPE_V6}, VIP_TYPE_V6},
+		{map[string]string{AVI_VIP_TYPE_LABEL: VIP_TYPE_DUAL}, VIP_TYPE_DUAL},
+		{map[string]string{AVI_VIP_TYPE_LABEL: "ipv6"}, VIP_TYPE_V4},
+		{map[string]string{AVI_VIP_TYPE_LABEL: ""}, VIP_TYPE_V4},
+	} {
+		if got := labelVipType(tc.labels, VIP_TYPE_V4, "web/app"); got != tc.want {
+			t.Errorf("labels %v: VIP type %s, want %s", tc.labels, got, tc.want)
+		}
+	}
+}
+
+func TestLabelBackendMode(t *testing.T) {
+	for _, tc := range []struct {
+		labels map[string]string
+		want   string
+	}{
+		{nil, BACKEND_MODE_HOSTPORT},
+		{map[string]string{AVI_BACKEND_MODE_LABEL: BACKEND_MODE_CONTAINER}, BACKEND_MODE_CONTAINER},
+		{map[string]string{AVI_BACKEND_MODE_LABEL: "overlay"}, BACKEND_MODE_HOSTPORT},
+		{map[string]string{AVI_BACKEND_MODE_LABEL: ""}, BACKEND_MODE_HOSTPORT},
+	} {
+		if got := labelBackendMode(tc.labels, BACKEND_MODE_HOSTPORT, "web/app"); got != tc.want {
+			t.Errorf("labels %v: backend mode %s, want %s", tc.labels, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+const (
+	DEFAULT_VS_NAME_TEMPLATE        = "{{.Environment}}-{{.Stack}}-{{.Service}}"
+	DEFAULT_POOL_NAME_TEMPLATE      = "{{.VS}}-pool-{{.Port}}-{{.Protocol}}"
+	DEFAULT_ZONE_POOL_NAME_TEMPLATE = "{{.VS}}-pool{{with .Group}}-{{.}}{{end}}{{with .Zone}}-{{.}}{{end}}"
+	DEFAULT_POOLGROUP_NAME_TEMPLATE = "{{.VS}}-poolgroup"
+	DEFAULT_VSVIP_NAME_TEMPLATE     = "{{.VS}}-vsvip"
+	DEFAULT_FQDN_TEMPLATE           = "{{.VS}}.{{.Subdomain}}"
+
+	DEFAULT_NAME_MAX_LENGTH = 64
+
+	// DNS limits
+	MAX_FQDN_LABEL_LENGTH = 63
+	MAX_FQDN_LENGTH       = 253
+)
+
+var (
+	unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+	unsafeDnsChars  = regexp.MustCompile(`[^a-z0-9-]+`)
+)
+
+// nameData is what the naming templates can refer to.
+type nameData struct {
+	Environment string
+	Stack       string
+	Service     string
+	VS          string
+	Port        int
+	Protocol    string
+	Subdomain   string
+	Zone        string // of pools split by zone
+	Group       string // of pools split by service sharing the VS
+}
+
+type aviNamer struct {
+	vs        *template.Template
+	pool      *template.Template
+	zonePool  *template.Template
+	poolGroup *template.Template
+	vsVip     *template.Template
+	fqdn      *template.Template
+	maxLen    int
+
+	// with the default templates, FQDNs and VsVip names stay as they
+	// were before naming templates
+	legacyFqdn  bool
+	legacyVsVip bool
+
+	// custom zone pool names count in the checksum, so that pools are
+	// renamed when the template changes
+	defaultZonePool bool
+
+	// the default VS template leaves out an empty environment or stack
+	// instead of leaving a dangling dash
+	defaultVs bool
+}
+
+func NewAviNamer(vs, pool, zonePool, poolGroup, vsVip, fqdn string, maxLen int) (*aviNamer, error) {
+	n := &aviNamer{
+		maxLen:      maxLen,
+		legacyFqdn:  fqdn == DEFAULT_FQDN_TEMPLATE,
+		legacyVsVip: vsVip == DEFAULT_VSVIP_NAME_TEMPLATE,
+		defaultVs:   vs == DEFAULT_VS_NAME_TEMPLATE,
+
+		defaultZonePool: zonePool == DEFAULT_ZONE_POOL_NAME_TEMPLATE,
+	}
+	var err error
+	if n.vs, err = template.New("vs").Parse(vs); err != nil {
+		return n, fmt.Errorf("Invalid VS name template %s: %v", vs, err)
+	}
+	if n.pool, err = template.New("pool").Parse(pool); err != nil {
+		return n, fmt.Errorf("Invalid pool name template %s: %v", pool, err)
+	}
+	if n.zonePool, err = template.New("zonepool").Parse(zonePool); err != nil {
+		return n, fmt.Errorf("Invalid zone pool name template %s: %v", zonePool, err)
+	}
+	if n.poolGroup, err = template.New("poolgroup").Parse(poolGroup); err != nil {
+		return n, fmt.Errorf("Invalid pool group name template %s: %v", poolGroup, err)
+	}
+	if n.vsVip, err = template.New("vsvip").Parse(vsVip); err != nil {
+		return n, fmt.Errorf("Invalid vsvip name template %s: %v", vsVip, err)
+	}
+	if n.fqdn, err = template.New("fqdn").Parse(fqdn); err != nil {
+		return n, fmt.Errorf("Invalid FQDN template %s: %v", fqdn, err)
+	}
+	return n, nil
+}
+
+// hashSuffix keeps truncated names unique and stable across restarts.
+func hashSuffix(name string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(name)))[:8]
+}
+
+func truncateName(name string, maxLen int) string {
+	if maxLen <= 0 || len(name) <= maxLen {
+		return name
+	}
+	suffix := hashSuffix(name)
+	if maxLen <= len(suffix)+1 {
+		return suffix[:maxLen]
+	}
+	return name[:maxLen-len(suffix)-1] + "-" + suffix
+}
+
+// SanitizeName replaces characters the controller rejects and truncates
+// the name to maxLen.
+func SanitizeName(name string, maxLen int) string {
+	name = unsafeNameChars.ReplaceAllString(name, "-")
+	return truncateName(name, maxLen)
+}
+
+// SanitizeFqdn lower-cases the FQDN and makes every label a valid DNS
+// label.
+func SanitizeFqdn(fqdn string) string {
+	labels := []string{}
+	for _, label := range strings.Split(strings.ToLower(fqdn), ".") {
+		label = strings.Trim(unsafeDnsChars.ReplaceAllString(label, "-"), "-")
+		if label == "" {
+			continue
+		}
+		labels = append(labels, truncateName(label, MAX_FQDN_LABEL_LENGTH))
+	}
+	return truncateName(strings.Join(labels, "."), MAX_FQDN_LENGTH)
+}
+
+func (n *aviNamer) execute(t *template.Template, data nameData, def string) string {
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		log.Errorf("Failed to render %s name for %s: %v", t.Name(), data.VS, err)
+		return def
+	}
+	return b.String()
+}
+
+// VSName renders the VS name template, sanitized. With the default
+// template an empty environment or stack is left out, so that a container
+// outside a stack is named <environment>-<service>.
+func (n *aviNamer) VSName(data nameData) string {
+	if n.defaultVs {
+		parts := []string{}
+		for _, part := range []string{data.Environment, data.Stack, data.Service} {
+			if part != "" {
+				parts = append(parts, part)
+			}
+		}
+		return SanitizeName(strings.Join(parts, "-"), n.maxLen)
+	}
+	def := fmt.Sprintf("%s-%s-%s", data.Environment, data.Stack, data.Service)
+	return SanitizeName(n.execute(n.vs, data, def), n.maxLen)
+}
+
+func (n *aviNamer) PoolName(data nameData) string {
+	def := fmt.Sprintf("%s-pool-%d-%s", data.VS, data.Port, data.Protocol)
+	return SanitizeName(n.execute(n.pool, data, def), n.maxLen)
+}
+
+func (n *aviNamer) PoolGroupName(data nameData) string {
+	def := fmt.Sprintf("%s-poolgroup", data.VS)
+	return SanitizeName(n.execute(n.poolGroup, data, def), n.maxLen)
+}
+
+func (n *aviNamer) VsVipName(data nameData) string {
+	def := fmt.Sprintf("%s-vsvip", data.VS)
+	return SanitizeName(n.execute(n.vsVip, data, def), n.maxLen)
+}
+
+// Fqdn renders the FQDN template, sanitized. The default template gives
+// the VS name and subdomain as they are, like before templates existed, so
+// that existing FQDNs don't change.
+func (n *aviNamer) Fqdn(data nameData) string {
+	def := fmt.Sprintf("%s.%s", data.VS, data.Subdomain)
+	if n.legacyFqdn {
+		return def
+	}
+	return SanitizeFqdn(n.execute(n.fqdn, data, def))
+}
+
+// HealthMonitorName follows the VS name, health monitors being per VS.
+func (n *aviNamer) HealthMonitorName(data nameData) string {
+	return SanitizeName(data.VS+"-healthmonitor", n.maxLen)
+}
+
+// ZonePoolName is the name of a pool of the members of one zone, or of
+// one service sharing the VS. Such a pool has no single port or protocol,
+// so it has a template of its own, after the VS rather than a member so
+// that it keeps its name as members come and go.
+func (n *aviNamer) ZonePoolName(data nameData) string {
+	def := data.VS + "-pool"
+	for _, part := range []string{data.Group, data.Zone} {
+		if part != "" {
+			def += "-" + part
+		}
+	}
+	return SanitizeName(n.execute(n.zonePool, data, def), n.maxLen)
+}
+
+// LegacyVSName is the VS name used before naming templates existed, used
+// to find VSes which need to be renamed.
+func LegacyVSName(data nameData) string {
+	return fmt.Sprintf("%s-%s-%s", data.Environment, data.Stack, data.Service)
+}
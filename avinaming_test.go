@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"io"
+	"testing"
+)
+
+func TestFqdnDefaultTemplate(t *testing.T) {
+	namer := testConfig(t).namer
+	data := nameData{VS: "Default-shop-Web_App", Subdomain: "example.com"}
+	if got := namer.Fqdn(data); got != "Default-shop-Web_App.example.com" {
+		t.Errorf("default template FQDN %s, want the VS name and subdomain unchanged", got)
+	}
+
+	custom, err := NewAviNamer(DEFAULT_VS_NAME_TEMPLATE, DEFAULT_POOL_NAME_TEMPLATE,
+		DEFAULT_ZONE_POOL_NAME_TEMPLATE, DEFAULT_POOLGROUP_NAME_TEMPLATE, DEFAULT_VSVIP_NAME_TEMPLATE, "{{.VS}}.apps.{{.Subdomain}}",
+		DEFAULT_NAME_MAX_LENGTH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := custom.Fqdn(data); got != "default-shop-web-app.apps.example.com" {
+		t.Errorf("custom template FQDN %s, want it sanitized", got)
+	}
+}
+
+func TestVSNameEmptyParts(t *testing.T) {
+	namer := testConfig(t).namer
+	for _, tc := range []struct {
+		data nameData
+		want string
+	}{
+		{nameData{Environment: "Default", Stack: "shop", Service: "web"}, "Default-shop-web"},
+		{nameData{Environment: "docker", Service: "web"}, "docker-web"},
+		{nameData{Stack: "shop", Service: "web"}, "shop-web"},
+		{nameData{Service: "web"}, "web"},
+	} {
+		if got := namer.VSName(tc.data); got != tc.want {
+			t.Errorf("%+v: VS name %s, want %s", tc.data, got, tc.want)
+		}
+	}
+
+	custom, err := NewAviNamer("{{.Environment}}_{{.Stack}}_{{.Service}}", DEFAULT_POOL_NAME_TEMPLATE,
+		DEFAULT_ZONE_POOL_NAME_TEMPLATE, DEFAULT_POOLGROUP_NAME_TEMPLATE, DEFAULT_VSVIP_NAME_TEMPLATE, DEFAULT_FQDN_TEMPLATE,
+		DEFAULT_NAME_MAX_LENGTH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := custom.VSName(nameData{Service: "web"}); got != "__web" {
+		t.Errorf("custom template VS name %s, want it rendered as is", got)
+	}
+}
+
+func TestChecksumBeforeTemplates(t *testing.T) {
+	task := &Vservice{
+		serviceName: "Default-shop-web",
+		names:       nameData{VS: "Default-shop-web"},
+		labels:      map[string]string{},
+		vipType:     VIP_TYPE_V4,
+		pools: []pool{{
+			protocol: "tcp",
+			hostip:   "10.0.0.1",
+			poolName: "Default-shop-web-pool-80-tcp",
+			ports:    map[int]int{80: 8080},
+			enabled:  true,
+		}},
+	}
+	// the checksum as computed before naming templates
+	h := md5.New()
+	io.WriteString(h, "Default-shop-web")
+	io.WriteString(h, "tcp")
+	io.WriteString(h, "10.0.0.1")
+	io.WriteString(h, "Default-shop-web-pool-80-tcp")
+	io.WriteString(h, "80")
+	io.WriteString(h, "8080")
+	if !bytes.Equal(CalculateChecksum(task, testConfig(t)), h.Sum(nil)) {
+		t.Errorf("checksum with default templates differs from the one before templates")
+	}
+}
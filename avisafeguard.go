@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	AVI_PROTECTED_LABEL = "avi_protected"
+)
+
+// pendingDelete tracks how long an object has been missing from the
+// desired state.
+type pendingDelete struct {
+	FirstMissing time.Time `json:"first_missing"`
+	Cycles       int       `json:"cycles"`
+}
+
+// deleteGuard holds back deletions until an object has been missing for
+// the grace period, and trips a circuit breaker when a single cycle wants
+// to delete too many VSes at once. A tripped breaker stays open until an
+// operator confirms the blocked set through the admin API.
+type deleteGuard struct {
+	sync.Mutex
+	graceCycles      int
+	gracePeriod      time.Duration
+	maxDeletes       int
+	maxDeletePercent int
+	dryRun           bool
+
+	pending   map[string]*pendingDelete
+	blocked   []string
+	confirmed map[string]bool
+}
+
+func NewDeleteGuard(cfg *AviConfig) *deleteGuard {
+	return &deleteGuard{
+		graceCycles:      cfg.deleteGraceCycles,
+		gracePeriod:      time.Duration(cfg.deleteGracePeriod) * time.Second,
+		maxDeletes:       cfg.maxDeletes,
+		maxDeletePercent: cfg.maxDeletePercent,
+		dryRun:           cfg.deleteDryRun,
+		pending:          make(map[string]*pendingDelete),
+		confirmed:        make(map[string]bool),
+	}
+}
+
+// Filter records one more observation of the missing keys and returns the
+// ones which have been missing long enough to be deleted. Keys which are
+// no longer missing are forgotten.
+func (g *deleteGuard) Filter(missing []string) []string {
+	g.Lock()
+	defer g.Unlock()
+
+	now := time.Now()
+	seen := make(map[string]bool)
+	ready := []string{}
+	for _, key := range missing {
+		seen[key] = true
+		pd, ok := g.pending[key]
+		if !ok {
+			pd = &pendingDelete{FirstMissing: now}
+			g.pending[key] = pd
+		}
+		pd.Cycles++
+		if pd.Cycles >= g.graceCycles && now.Sub(pd.FirstMissing) >= g.gracePeriod {
+			ready = append(ready, key)
+		} else {
+			log.Infof("Holding deletion of %s: missing for %d cycles since %s",
+				key, pd.Cycles, pd.FirstMissing.Format(time.RFC3339))
+		}
+	}
+	for key := range g.pending {
+		if !seen[key] {
+			log.Infof("%s is back in desired state, cancelling deletion", key)
+			delete(g.pending, key)
+		}
+	}
+	sort.Strings(ready)
+	return ready
+}
+
+// Allow checks the VS deletions of one cycle against the circuit breaker.
+// managed is the number of VSes currently owned by Rancher.
+func (g *deleteGuard) Allow(candidates []string, managed int) bool {
+	g.Lock()
+	defer g.Unlock()
+
+	if len(candidates) == 0 {
+		g.blocked = nil
+		return true
+	}
+
+	tripped := false
+	if g.maxDeletes > 0 && len(candidates) > g.maxDeletes {
+		tripped = true
+	}
+	if g.maxDeletePercent > 0 && len(candidates) > 1 && managed > 0 &&
+		len(candidates)*100 > g.maxDeletePercent*managed {
+		tripped = true
+	}
+	if !tripped {
+		g.blocked = nil
+		return true
+	}
+
+	allConfirmed := true
+	for _, name := range candidates {
+		if !g.confirmed[name] {
+			allConfirmed = false
+			break
+		}
+	}
+	if allConfirmed {
+		log.Infof("Mass deletion of %d of %d VSes confirmed by operator", len(candidates), managed)
+		g.confirmed = make(map[string]bool)
+		g.blocked = nil
+		return true
+	}
+
+	log.Errorf("Refusing to delete %d of %d VSes in one cycle without confirmation: %v",
+		len(candidates), managed, candidates)
+	g.blocked = candidates
+	return false
+}
+
+// Confirm allows the currently blocked deletions to go ahead on the next
+// cycle, and returns them.
+func (g *deleteGuard) Confirm() []string {
+	g.Lock()
+	defer g.Unlock()
+
+	g.confirmed = make(map[string]bool)
+	for _, name := range g.blocked {
+		g.confirmed[name] = true
+	}
+	return g.blocked
+}
+
+func (g *deleteGuard) status() map[string]interface{} {
+	g.Lock()
+	defer g.Unlock()
+
+	pending := make(map[string]pendingDelete)
+	for key, pd := range g.pending {
+		pending[key] = *pd
+	}
+	confirmed := []string{}
+	for name := range g.confirmed {
+		confirmed = append(confirmed, name)
+	}
+	sort.Strings(confirmed)
+	return map[string]interface{}{
+		"pending":   pending,
+		"blocked":   g.blocked,
+		"confirmed": confirmed,
+		"dry_run":   g.dryRun,
+	}
+}
+
+// VsIsProtected returns true if the VS carries the protected label, either
+// propagated from the Rancher service or set directly on the controller.
+func VsIsProtected(vs map[string]interface{}) bool {
+	labels, ok := vs["labels"].([]interface{})
+	if !ok {
+		return false
+	}
+	for _, l := range labels {
+		kv, ok := l.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if kv["key"] == AVI_PROTECTED_LABEL && kv["value"] == "true" {
+			return true
+		}
+	}
+	return false
+}
+
+// setProtectedLabel returns the VS labels with the protected label set or
+// cleared, leaving any other labels untouched.
+func setProtectedLabel(labels interface{}, protected bool) []interface{} {
+	retained := make([]interface{}, 0)
+	if ls, ok := labels.([]interface{}); ok {
+		for _, l := range ls {
+			kv, ok := l.(map[string]interface{})
+			if ok && kv["key"] == AVI_PROTECTED_LABEL {
+				continue
+			}
+			retained = append(retained, l)
+		}
+	}
+	if protected {
+		kv := make(map[string]interface{})
+		kv["key"] = AVI_PROTECTED_LABEL
+		kv["value"] = "true"
+		retained = append(retained, kv)
+	}
+	return retained
+}
+
+func serviceIsProtected(task *Vservice) bool {
+	return labelEnabled(task.labels, AVI_PROTECTED_LABEL)
+}
+
+// adminAuth lets only requests carrying the AVI_ADMIN_TOKEN bearer token
+// through to an admin action, and none if no token is set.
+func adminAuth(token string, action http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if token == "" {
+			http.Error(w, "Admin actions are disabled, set AVI_ADMIN_TOKEN", http.StatusForbidden)
+			return
+		}
+		auth := []byte(req.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(auth, []byte("Bearer "+token)) != 1 {
+			log.Warnf("Unauthorized admin request %s %s from %s", req.Method, req.URL.Path, req.RemoteAddr)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		action(w, req)
+	}
+}
+
+func adminDeletions(w http.ResponseWriter, req *http.Request) {
+	b, _ := json.MarshalIndent(p.deleteGuard.status(), "", " ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func adminConfirmDeletions(w http.ResponseWriter, req *http.Request) {
+	confirmed := p.deleteGuard.Confirm()
+	log.Infof("Operator confirmed deletion of %v", confirmed)
+	b, _ := json.MarshalIndent(map[string]interface{}{"confirmed": confirmed}, "", " ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
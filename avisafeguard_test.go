@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminAuth(t *testing.T) {
+	for _, tc := range []struct {
+		token  string
+		header string
+		status int
+	}{
+		{"", "", http.StatusForbidden},
+		{"", "Bearer ", http.StatusForbidden},
+		{"secret", "", http.StatusUnauthorized},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "secret", http.StatusUnauthorized},
+		{"secret", "Bearer secret", http.StatusOK},
+	} {
+		called := false
+		h := adminAuth(tc.token, func(w http.ResponseWriter, req *http.Request) {
+			called = true
+		})
+		req := httptest.NewRequest("POST", "/admin/deletions/confirm", nil)
+		if tc.header != "" {
+			req.Header.Set("Authorization", tc.header)
+		}
+		w := httptest.NewRecorder()
+		h(w, req)
+		if w.Code != tc.status || called != (tc.status == http.StatusOK) {
+			t.Errorf("token %q, header %q: status %d, called %v", tc.token, tc.header, w.Code, called)
+		}
+	}
+}
+
+func TestDeleteGuardFilter(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		cycles int
+		period time.Duration
+		since  time.Duration // how long ago the key first went missing, if before the rounds
+		rounds [][]string
+		ready  []string // of the last round
+	}{
+		{"no grace", 0, 0, 0, [][]string{{"a", "b"}}, []string{"a", "b"}},
+		{"first of three cycles", 3, 0, 0, [][]string{{"a"}}, []string{}},
+		{"third of three cycles", 3, 0, 0, [][]string{{"a"}, {"a"}, {"a"}}, []string{"a"}},
+		{"back in desired state", 3, 0, 0, [][]string{{"a"}, {"a"}, {}, {"a"}}, []string{}},
+		{"only the ones missing long enough", 2, 0, 0, [][]string{{"a"}, {"a", "b"}}, []string{"a"}},
+		{"within grace period", 0, time.Minute, 0, [][]string{{"a"}}, []string{}},
+		{"grace period over", 0, time.Minute, 2 * time.Minute, [][]string{{"a"}}, []string{"a"}},
+		{"period over but too few cycles", 3, time.Minute, 2 * time.Minute, [][]string{{"a"}}, []string{}},
+	} {
+		g := NewDeleteGuard(&AviConfig{deleteGraceCycles: tc.cycles})
+		g.gracePeriod = tc.period
+		if tc.since > 0 {
+			g.pending["a"] = &pendingDelete{FirstMissing: time.Now().Add(-tc.since)}
+		}
+		var ready []string
+		for _, missing := range tc.rounds {
+			ready = g.Filter(missing)
+		}
+		if !reflect.DeepEqual(ready, tc.ready) {
+			t.Errorf("%s: ready %v, want %v", tc.name, ready, tc.ready)
+		}
+	}
+}
+
+func TestDeleteGuardAllow(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		maxDeletes int
+		maxPercent int
+		candidates int
+		managed    int
+		allowed    bool
+	}{
+		{"nothing to delete", 1, 10, 0, 100, true},
+		{"breaker disabled", 0, 0, 50, 100, true},
+		{"at count limit", 5, 0, 5, 100, true},
+		{"over count limit", 5, 0, 6, 100, false},
+		{"at percent limit", 0, 10, 10, 100, true},
+		{"over percent limit", 0, 10, 11, 100, false},
+		{"single deletion over percent", 0, 10, 1, 2, true},
+		{"no managed VSes", 0, 10, 3, 0, true},
+		{"count over, percent under", 2, 50, 3, 100, false},
+		{"count under, percent over", 10, 10, 3, 10, false},
+	} {
+		g := NewDeleteGuard(&AviConfig{maxDeletes: tc.maxDeletes, maxDeletePercent: tc.maxPercent})
+		candidates := []string{}
+		for i := 0; i < tc.candidates; i++ {
+			candidates = append(candidates, fmt.Sprintf("vs-%d", i))
+		}
+		if allowed := g.Allow(candidates, tc.managed); allowed != tc.allowed {
+			t.Errorf("%s: allowed %v, want %v", tc.name, allowed, tc.allowed)
+		}
+		if blocked := len(g.blocked) > 0; blocked == tc.allowed {
+			t.Errorf("%s: blocked %v", tc.name, g.blocked)
+		}
+	}
+}
+
+func TestDeleteGuardConfirm(t *testing.T) {
+	g := NewDeleteGuard(&AviConfig{maxDeletes: 1})
+	if confirmed := g.Confirm(); len(confirmed) != 0 {
+		t.Errorf("confirmed %v with nothing blocked", confirmed)
+	}
+	if g.Allow([]string{"a", "b"}, 10) {
+		t.Fatal("breaker did not trip")
+	}
+	if confirmed := g.Confirm(); !reflect.DeepEqual(confirmed, []string{"a", "b"}) {
+		t.Errorf("confirmed %v, want the blocked VSes", confirmed)
+	}
+	if g.Allow([]string{"a", "b", "c"}, 10) {
+		t.Error("confirmation extended to a VS which was not blocked")
+	}
+	g.Confirm()
+	if !g.Allow([]string{"a", "b", "c"}, 10) {
+		t.Error("confirmed deletions refused")
+	}
+	// a confirmation is used up once the deletions went ahead
+	if g.Allow([]string{"a", "b", "c"}, 10) {
+		t.Error("confirmation reused")
+	}
+	// the breaker resets once a cycle is within the limits
+	if !g.Allow([]string{"a"}, 10) || g.blocked != nil {
+		t.Errorf("breaker not reset, blocked %v", g.blocked)
+	}
+}
+
+func TestGetAllVses(t *testing.T) {
+	cloud := "https://avi/api/cloud/cloud-1"
+	session, reqs := fakeAvi(t, func(req aviRequest) interface{} {
+		if strings.Contains(req.query, "page=1") {
+			return map[string]interface{}{
+				"count": 3,
+				"next":  "https://avi/api/virtualservice?page=2",
+				"results": []map[string]interface{}{
+					{"name": "web", "cloud_ref": cloud + "#Default-Cloud"},
+					{"name": "other", "cloud_ref": "https://avi/api/cloud/cloud-2"},
+				},
+			}
+		}
+		return map[string]interface{}{
+			"count":   3,
+			"results": []map[string]interface{}{{"name": "api", "cloud_ref": cloud}},
+		}
+	})
+	p := &Avi{aviSession: session, cloudRef: cloud}
+	vses, err := p.GetAllVses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, vs := range vses {
+		names = append(names, vs["name"].(string))
+	}
+	if !reflect.DeepEqual(names, []string{"web", "api"}) {
+		t.Errorf("got VSes %v, want web and api of the cloud", names)
+	}
+	for _, req := range *reqs {
+		if !strings.Contains(req.query, "created_by="+CREATED_BY) {
+			t.Errorf("request %s?%s not limited to Rancher's VSes", req.path, req.query)
+		}
+	}
+}
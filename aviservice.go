@@ -5,6 +5,7 @@ import (
 	"strconv"
 	"crypto/md5"
 	"io"
+	"net"
 	"strings"
 	"encoding/json"
 )
@@ -24,14 +25,57 @@ const (
 	SSL_STANDARD_CERT           = "System-Default-Cert"
 
 
+	// value of created_by on objects owned by this integration
+	CREATED_BY                  = "Rancher"
+
 	AVI_INTEGRATION_LABEL       = "no_avi_proxy"
 	AVI_PROXY_LABEL             = "avi_proxy"
+	AVI_HEALTH_POLICY_LABEL     = "avi_health_policy"
+	AVI_BACKEND_MODE_LABEL      = "avi_backend_mode"
+	AVI_CONTAINER_PORTS_LABEL   = "avi_container_ports"
+	AVI_PLACEMENT_NETWORK_LABEL = "avi_placement_network"
+	AVI_PLACEMENT_SUBNET_LABEL  = "avi_placement_subnet"
+	AVI_EXTERNAL_PORTS_LABEL    = "avi_external_ports"
+	AVI_SERVER_RATIO_LABEL      = "avi_server_ratio"
+
+	// limits of pool server ratios
+	MIN_SERVER_RATIO            = 1
+	MAX_SERVER_RATIO            = 20
+
+	AVI_VIP_TYPE_LABEL          = "avi_vip_type"
+
+	// address families of auto allocated VIPs
+	VIP_TYPE_V4                 = "v4"
+	VIP_TYPE_V6                 = "v6"
+	VIP_TYPE_DUAL               = "dual"
+
+	// pool servers are published host ports or container IPs
+	BACKEND_MODE_HOSTPORT       = "hostport"
+	BACKEND_MODE_CONTAINER      = "container"
+
+	// Rancher service kinds without containers of their own
+	SERVICE_KIND_EXTERNAL       = "externalService"
+	SERVICE_KIND_ALIAS          = "dnsService"
+
+	// what to do with running containers which are not healthy
+	HEALTH_POLICY_DISABLE       = "disable"
+	HEALTH_POLICY_REMOVE        = "remove"
+	HEALTH_POLICY_IGNORE        = "ignore"
 )
 
 type Vservice struct {
         serviceName string
         labels      map[string]string // list of lables on services
         pools       []pool // Pool servers in Avi
+        owner       string // stack/service the VS was built from
+        conflicts   []string // other stack/services claiming the same VS
+        names       nameData // input to the naming templates
+        legacyName  string // VS name before naming templates, if different
+        backendMode string // hostport or container
+        vipType     string // v4, v6 or dual
+        healthCheck *healthCheck // nil if the service has none
+        localZone   string // zone preferred for traffic
+        splits      map[string]trafficSplit // traffic split by owner of services sharing the VS
 }
 
 type pool struct {
@@ -39,6 +83,10 @@ type pool struct {
         hostip string // Host IP
         poolName    string
         ports map[int]int // Host to Container port mapping
+        enabled     bool // false for members of unhealthy containers
+        zone        string // zone of the host, if zones are configured
+        group       string // owner of the service, if it shares the VS
+        ratio       int // server ratio, 0 for Avi's default
 }
 
 
@@ -93,17 +141,65 @@ func apply_labels_data(vs map[string]interface{}, result interface{}) {
 	return
 }
 
-func CalculateChecksum(task *Vservice) []byte {
+func CalculateChecksum(task *Vservice, cfg *AviConfig) []byte {
+	namer := cfg.namer
 	h := md5.New()
 	io.WriteString(h, task.serviceName)
+	// only names which differ from those before naming templates count,
+	// so that upgrading with the default templates updates no VS
+	if pg := namer.PoolGroupName(task.names); pg != task.serviceName+"-poolgroup" {
+		io.WriteString(h, pg)
+	}
+	if vip := namer.VsVipName(task.names); vip != task.serviceName+"-vsvip" {
+		io.WriteString(h, vip)
+	}
+	if !namer.defaultZonePool {
+		for _, zp := range zonePools(task) {
+			if zp.group != "" || zp.zone != "" {
+				io.WriteString(h, namer.ZonePoolName(zp.names(task)))
+			}
+		}
+	}
 	val, ok := task.labels[AVI_PROXY_LABEL]
 	if ok {
 		io.WriteString(h, val)
 	}
+	if serviceIsProtected(task) {
+		io.WriteString(h, AVI_PROTECTED_LABEL)
+	}
+	if task.vipType != VIP_TYPE_V4 {
+		io.WriteString(h, task.vipType)
+	}
+	if task.healthCheck != nil {
+		io.WriteString(h, fmt.Sprintf("%+v", *task.healthCheck))
+	}
+	if task.localZone != "" {
+		io.WriteString(h, task.localZone)
+	}
+	if len(task.splits) > 0 {
+		io.WriteString(h, splitChecksum(task.splits))
+	}
+	if task.backendMode == BACKEND_MODE_CONTAINER {
+		network, subnet := placementNetwork(task, cfg)
+		io.WriteString(h, network)
+		io.WriteString(h, subnet)
+	}
 	for _, val := range task.pools {
 		io.WriteString(h, val.protocol)
 		io.WriteString(h, val.hostip)
 		io.WriteString(h, val.poolName)
+		if !val.enabled {
+			io.WriteString(h, "disabled")
+		}
+		if val.zone != "" {
+			io.WriteString(h, val.zone)
+		}
+		if val.group != "" {
+			io.WriteString(h, val.group)
+		}
+		if val.ratio != 0 {
+			io.WriteString(h, "ratio"+strconv.Itoa(val.ratio))
+		}
 		for publicport, privateport := range val.ports {
 			io.WriteString(h, strconv.Itoa(publicport))
 			io.WriteString(h, strconv.Itoa(privateport))
@@ -112,19 +208,99 @@ func CalculateChecksum(task *Vservice) []byte {
 	return h.Sum(nil)
 }
 
-func configure_vip() []map[string]interface{} {
+// autoAllocateIpType returns the address families allocated for a VIP of
+// the type.
+func autoAllocateIpType(vipType string) string {
+	switch vipType {
+	case VIP_TYPE_V6:
+		return "V6_ONLY"
+	case VIP_TYPE_DUAL:
+		return "V4_V6"
+	}
+	return "V4_ONLY"
+}
+
+func configure_vip(vipType string) []map[string]interface{} {
 	var slice []map[string]interface{}
 	vip := make(map[string]interface{})
 	vip["auto_allocate_ip"] = true
+	if vipType != VIP_TYPE_V4 {
+		vip["auto_allocate_ip_type"] = autoAllocateIpType(vipType)
+	}
 	slice = append(slice, vip)
 	return slice
 }
 
-func configure_fqdn(relname string, subdomain string) []map[string]interface{} {
+// setVipType switches the auto allocated VIPs of an existing VsVip to the
+// address families of the VIP type, releasing addresses of a family no
+// longer wanted. Static VIPs are left alone.
+func setVipType(vsvip map[string]interface{}, vipType string) {
+	ipType := autoAllocateIpType(vipType)
+	vips, _ := vsvip["vip"].([]interface{})
+	for _, v := range vips {
+		vip, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if auto, _ := vip["auto_allocate_ip"].(bool); !auto {
+			if vipType != VIP_TYPE_V4 {
+				log.Warnf("VIP of VsVip %s is not auto allocated, ignoring VIP type %s", vsvip["name"], vipType)
+			}
+			continue
+		}
+		if current, _ := vip["auto_allocate_ip_type"].(string); current == ipType || (current == "" && ipType == "V4_ONLY") {
+			continue
+		}
+		log.Infof("Changing VIP type of VsVip %s to %s", vsvip["name"], vipType)
+		vip["auto_allocate_ip_type"] = ipType
+		switch ipType {
+		case "V4_ONLY":
+			delete(vip, "ip6_address")
+		case "V6_ONLY":
+			delete(vip, "ip_address")
+		}
+	}
+}
+
+func (p *Avi)configure_vsvip(task *Vservice, create bool, vs_update map[string]interface{}) map[string]interface{} {
+	vsvip := make(map[string]interface{})
+	vsvip["name"] = p.cfg.namer.VsVipName(task.names)
+	vsvip["cloud_ref"] = p.cloudRef
+	vsvip["tenant_ref"], _ = p.aviSession.GetTenantRef(p.cfg.tenant)
+	vsvip["vip"] = configure_vip(task.vipType)
+	// VsVips made here are Rancher's, so they are garbage collected;
+	// existing ones keep their owner
+	vsvip["created_by"] = CREATED_BY
+	if vip_ref, ok := vs_update["vsvip_ref"].(string); !create && ok {
+		// keep the existing VsVip as it is, owner included; only its name
+		// and VIP type may change
+		delete(vs_update, "vip")
+		res, err := p.aviSession.Get("/api/vsvip/" + refUuid(vip_ref))
+		existing, _ := res.(map[string]interface{})
+		if err != nil || existing == nil {
+			vsvip["uuid"] = refUuid(vip_ref)
+			delete(vsvip, "created_by")
+			delete(vsvip, "vip")
+			return vsvip
+		}
+		if !p.cfg.namer.legacyVsVip {
+			existing["name"] = vsvip["name"]
+		}
+		setVipType(existing, task.vipType)
+		return existing
+	} else if vip, ok := vs_update["vip"]; !create && ok {
+		// move the inline VIP over so the address doesn't change
+		vsvip["vip"] = vip
+		delete(vs_update, "vip")
+	}
+	return vsvip
+}
+
+func (p *Avi)configure_fqdn(task *Vservice) []map[string]interface{} {
 	var dns []map[string]interface{}
 	d := make(map[string]interface{})
-	if subdomain != "" {
-		d["fqdn"] = relname+"."+subdomain
+	if p.cfg.dnsSubDomain != "" || p.cfg.fqdnTemplate {
+		d["fqdn"] = p.cfg.namer.Fqdn(task.names)
 		dns = append(dns, d)
 	}
 	return dns
@@ -221,38 +397,103 @@ func configure_pool_hms(task *Vservice) ([]string, string) {
 	return hm, ssl_prof
 }
 
-func configure_pool_servers(task *Vservice) ([]map[string]interface{}, string) {
+func configure_pool_servers(members []pool) ([]map[string]interface{}, string) {
 	var s []map[string]interface{}
 	var name string
-	for _, pool := range task.pools {
+	seen := make(map[string]bool)
+	for _, pool := range members {
 		name = pool.poolName
 		for publicport, _ := range pool.ports {
+			// a tcp+udp mapping is a single server
+			key := makeKey(pool.hostip, strconv.Itoa(publicport))
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
 			server := make(map[string]interface{})
 			ip := make(map[string]interface{})
-			ip["type"] = "V4"
+			ip["type"] = ipAddrType(pool.hostip)
 			ip["addr"] = pool.hostip
 			server["ip"] = ip
 			server["port"] = publicport
+			server["enabled"] = pool.enabled
+			if pool.ratio != 0 {
+				server["ratio"] = pool.ratio
+			}
 			s = append(s, server)
 		}
 	}
 	return s, name
 }
 
-func (p *Avi)configure_pool(task *Vservice, create bool, pg map[string]interface{}) map[string]interface{} {
+// placementNetwork returns the network and subnet the Service Engines
+// reach the containers of the service on, from its labels else the
+// provider's.
+func placementNetwork(task *Vservice, cfg *AviConfig) (string, string) {
+	network := cfg.placementNetwork
+	if val, ok := task.labels[AVI_PLACEMENT_NETWORK_LABEL]; ok {
+		network = val
+	}
+	subnet := cfg.placementSubnet
+	if val, ok := task.labels[AVI_PLACEMENT_SUBNET_LABEL]; ok {
+		subnet = val
+	}
+	return network, subnet
+}
+
+// configure_placement_networks tells the Service Engines which network
+// reaches the container IPs.
+func (p *Avi)configure_placement_networks(task *Vservice) []map[string]interface{} {
+	var placement []map[string]interface{}
+	network, subnet := placementNetwork(task, p.cfg)
+	if network == "" || subnet == "" {
+		return placement
+	}
+	_, ipnet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		log.Warnf("Invalid placement subnet %s for VS %s: %v", subnet, task.serviceName, err)
+		return placement
+	}
+	mask, _ := ipnet.Mask.Size()
+	addr := make(map[string]interface{})
+	addr["addr"] = ipnet.IP.String()
+	addr["type"] = ipAddrType(addr["addr"].(string))
+	sn := make(map[string]interface{})
+	sn["ip_addr"] = addr
+	sn["mask"] = mask
+	pn := make(map[string]interface{})
+	pn["network_ref"] = "/api/network?name=" + network
+	pn["subnet"] = sn
+	placement = append(placement, pn)
+	return placement
+}
+
+func (p *Avi)configure_pool(task *Vservice, zp zonePool, hm_refs []string, ssl_prof string, create bool, pg map[string]interface{}) map[string]interface{} {
 	pool := make(map[string]interface{})
 	pool["cloud_ref"] = p.cloudRef
 	pool["tenant_ref"], _ = p.aviSession.GetTenantRef(p.cfg.tenant)
-	hm_refs, ssl_prof := configure_pool_hms(task)
+	pool["created_by"] = CREATED_BY
 	if len(hm_refs) > 0 {
 		pool["health_monitor_refs"] = hm_refs
 	}
 	if ssl_prof != "" {
 		pool["ssl_profile_ref"] = ssl_prof
 	}
-	pool["servers"], pool["name"] = configure_pool_servers(task)
+	servers, name := configure_pool_servers(zp.members)
+	pool["servers"] = servers
+	if zp.group != "" || zp.zone != "" {
+		name = p.cfg.namer.ZonePoolName(zp.names(task))
+	}
+	pool["name"] = name
+	if task.backendMode == BACKEND_MODE_CONTAINER {
+		placement := p.configure_placement_networks(task)
+		if len(placement) > 0 {
+			pool["placement_networks"] = placement
+		}
+	}
 	if !create {
-		for _, poolmem := range pg["members"].([]interface{}) {
+		members, _ := pg["members"].([]interface{})
+		for _, poolmem := range members {
 			pool_tokens := strings.Split(poolmem.(map[string]interface{})["pool_ref"].(string), "/")
 			pool["uuid"] = pool_tokens[len(pool_tokens)-1]
 		}
@@ -279,12 +520,49 @@ func (p *Avi)configure_poolgmembers(task *Vservice, create bool, vs_update map[s
 	var poolg []map[string]interface{}
 	var pg map[string]interface{}
 	poolgmem := make(map[string]interface{})
-	if !create {
-		pg_name := fmt.Sprintf("%s-poolgroup", task.serviceName)
-		pg, _ = p.GetPoolGroup(pg_name)
+	if pg_ref, ok := vs_update["pool_group_ref"].(string); !create && ok {
+		// look up by uuid, the pool group may be about to be renamed
+		res, err := p.aviSession.Get("/api/poolgroup/" + refUuid(pg_ref))
+		if err == nil {
+			pg, _ = res.(map[string]interface{})
+		}
+	}
+	hm_refs, ssl_prof := configure_pool_hms(task)
+	if hm_ref, ok := p.EnsureHealthMonitor(task); ok {
+		hm_refs = []string{hm_ref}
+	}
+	zps := zonePools(task)
+	if len(zps) == 1 && zps[0].zone == "" && zps[0].group == "" {
+		poolgmem["pool_ref_data"] = p.configure_pool(task, zps[0], hm_refs, ssl_prof, create, pg)
+		poolg = append(poolg, poolgmem)	
+		return poolg
+	}
+	// a pool per service and zone, the local zone taking traffic first
+	// unless the services sharing the VS set priorities
+	zoned := false
+	for _, zp := range zps {
+		zoned = zoned || zp.zone != ""
+	}
+	for _, zp := range zps {
+		poolgmem := make(map[string]interface{})
+		pool := p.configure_pool(task, zp, hm_refs, ssl_prof, true, nil)
+		if !create {
+			if uuid := p.ownedPoolUuid(pool["name"].(string)); uuid != "" {
+				pool["uuid"] = uuid
+			}
+		}
+		poolgmem["pool_ref_data"] = pool
+		if split, ok := task.splits[zp.group]; ok {
+			poolgmem["ratio"] = split.Ratio
+			if split.Priority != "" {
+				poolgmem["priority_label"] = split.Priority
+			}
+		}
+		if _, ok := poolgmem["priority_label"]; !ok && zoned {
+			poolgmem["priority_label"] = zonePriority(task, zp.zone)
+		}
+		poolg = append(poolg, poolgmem)
 	}
-	poolgmem["pool_ref_data"] = p.configure_pool(task, create, pg)
-	poolg = append(poolg, poolgmem)	
 	return poolg
 }
 
@@ -292,10 +570,11 @@ func (p *Avi)configure_poolgroup(task *Vservice, create bool, vs_update map[stri
 	poolg := make(map[string]interface{})
 	poolg["cloud_ref"] = p.cloudRef
 	poolg["tenant_ref"], _ = p.aviSession.GetTenantRef(p.cfg.tenant)
-	poolg["name"] = fmt.Sprintf("%s-poolgroup", task.serviceName)
+	poolg["name"] = p.cfg.namer.PoolGroupName(task.names)
+	poolg["created_by"] = CREATED_BY
 	poolg["members"] = p.configure_poolgmembers(task, create, vs_update)
-	if !create {
-		poolg_tokens := strings.Split(vs_update["pool_group_ref"].(string), "/")
+	if pg_ref, ok := vs_update["pool_group_ref"].(string); !create && ok {
+		poolg_tokens := strings.Split(pg_ref, "/")
 		poolg["uuid"] = poolg_tokens[len(poolg_tokens)-1]
 	}
 	return poolg
@@ -306,12 +585,12 @@ func (p *Avi) CreateUpdateVS(task *Vservice, create bool, vs_update map[string]i
 	vs := make(map[string]interface{})
 	vs["name"] = task.serviceName
 	vs["cloud_ref"] = p.cloudRef
-	vs["created_by"] = "Rancher"
-	vs["cloud_config_cksum"] = fmt.Sprintf("%x", CalculateChecksum(task))
+	vs["created_by"] = CREATED_BY
+	vs["cloud_config_cksum"] = fmt.Sprintf("%x", CalculateChecksum(task, p.cfg))
 
-	vs["vip"] = configure_vip()
+	vs["vsvip_ref_data"] = p.configure_vsvip(task, create, vs_update)
 
-	dns_info := configure_fqdn(task.serviceName, p.cfg.dnsSubDomain)
+	dns_info := p.configure_fqdn(task)
 	if len(dns_info) > 0 {
 		vs["dns_info"] = dns_info
 	}
@@ -350,9 +629,18 @@ func (p *Avi) CreateUpdateVS(task *Vservice, create bool, vs_update map[string]i
 	var err error
 	model := make(map[string]interface{})
 	if !create {
+		createdBy, adopted := VsAdoption(vs_update)
+		vs_update["labels"] = setProtectedLabel(vs_update["labels"], serviceIsProtected(task))
 		apply_labels_data(vs_update, vs)
+		if adopted {
+			// labels from avi_proxy must not lose the VS's original owner
+			vs_update["labels"] = setAdoptedLabel(vs_update["labels"], createdBy, true)
+		}
 		model["data"] = vs_update
 	} else {
+		if serviceIsProtected(task) {
+			vs["labels"] = setProtectedLabel(nil, true)
+		}
 		model["data"] = vs
 	}
 	model["model_name"] = "VirtualService"
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestChecksumPlacement(t *testing.T) {
+	cfg := testConfig(t)
+	task := &Vservice{
+		serviceName: "web",
+		names:       nameData{VS: "web"},
+		labels:      map[string]string{},
+		backendMode: BACKEND_MODE_CONTAINER,
+		vipType:     VIP_TYPE_V4,
+	}
+	cfg.placementNetwork = "overlay"
+	cfg.placementSubnet = "10.42.0.0/16"
+	sum := CalculateChecksum(task, cfg)
+
+	cfg.placementSubnet = "10.43.0.0/16"
+	changed := CalculateChecksum(task, cfg)
+	if bytes.Equal(sum, changed) {
+		t.Errorf("checksum unchanged by AVI_PLACEMENT_SUBNET")
+	}
+
+	// a label overriding the provider's network hides its changes
+	task.labels[AVI_PLACEMENT_SUBNET_LABEL] = "10.44.0.0/16"
+	sum = CalculateChecksum(task, cfg)
+	cfg.placementSubnet = "10.42.0.0/16"
+	if !bytes.Equal(sum, CalculateChecksum(task, cfg)) {
+		t.Errorf("checksum changed by AVI_PLACEMENT_SUBNET overridden by a label")
+	}
+}
+
+func TestSetVipType(t *testing.T) {
+	for _, tc := range []struct {
+		vip     map[string]interface{}
+		vipType string
+		want    map[string]interface{}
+	}{
+		{
+			map[string]interface{}{"auto_allocate_ip": true, "ip_address": "10.0.0.1"},
+			VIP_TYPE_V4,
+			map[string]interface{}{"auto_allocate_ip": true, "ip_address": "10.0.0.1"},
+		},
+		{
+			map[string]interface{}{"auto_allocate_ip": true, "ip_address": "10.0.0.1"},
+			VIP_TYPE_DUAL,
+			map[string]interface{}{"auto_allocate_ip": true, "auto_allocate_ip_type": "V4_V6", "ip_address": "10.0.0.1"},
+		},
+		{
+			map[string]interface{}{"auto_allocate_ip": true, "ip_address": "10.0.0.1"},
+			VIP_TYPE_V6,
+			map[string]interface{}{"auto_allocate_ip": true, "auto_allocate_ip_type": "V6_ONLY"},
+		},
+		{
+			map[string]interface{}{"auto_allocate_ip": true, "auto_allocate_ip_type": "V4_V6", "ip_address": "10.0.0.1", "ip6_address": "2001:db8::1"},
+			VIP_TYPE_V4,
+			map[string]interface{}{"auto_allocate_ip": true, "auto_allocate_ip_type": "V4_ONLY", "ip_address": "10.0.0.1"},
+		},
+		{
+			map[string]interface{}{"ip_address": "10.0.0.1"},
+			VIP_TYPE_V6,
+			map[string]interface{}{"ip_address": "10.0.0.1"},
+		},
+	} {
+		orig := fmt.Sprint(tc.vip)
+		vsvip := map[string]interface{}{"name": "web-vsvip", "vip": []interface{}{tc.vip}}
+		setVipType(vsvip, tc.vipType)
+		if !reflect.DeepEqual(tc.vip, tc.want) {
+			t.Errorf("%s to %s: got %v, want %v", orig, tc.vipType, tc.vip, tc.want)
+		}
+	}
+}
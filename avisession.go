@@ -107,7 +107,7 @@ func NewAviSession(host string, username string, password string, insecure bool,
 }
 
 func (avisession *AviSession) InitiateSession() error {
-	log.Info("Initiating session %s, %s, %s", avisession.prefix, avisession.username, avisession.insecure)
+	log.Infof("Initiating session %s, %s, %v", avisession.prefix, avisession.username, avisession.insecure)
 	if avisession.insecure == true {
 		log.Warn("Strict certificate verification is *DISABLED*")
 	}
@@ -250,6 +250,7 @@ func ConvertAviResponseToMapInterface(resbytes []byte) (interface{}, error) {
 type AviCollectionResult struct {
 	Count   int
 	Results []json.RawMessage
+	Next    string
 }
 
 func ConvertBytesToSpecificInterface(resbytes []byte, result interface{}) error {
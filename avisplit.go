@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+const (
+	// services carrying this label may share a VS, each getting its own
+	// pool group member
+	AVI_SPLIT_LABEL          = "avi_split"
+	AVI_SPLIT_RATIO_LABEL    = "avi_split_ratio"
+	AVI_SPLIT_PRIORITY_LABEL = "avi_split_priority"
+
+	// limits of pool group member ratios
+	MIN_SPLIT_RATIO = 1
+	MAX_SPLIT_RATIO = 1000
+)
+
+// trafficSplit is the share of a VS's traffic going to one of the
+// services behind it.
+type trafficSplit struct {
+	Ratio    int    `json:"ratio"`
+	Priority string `json:"priority,omitempty"`
+}
+
+func splitEnabled(labels map[string]string) bool {
+	return labelEnabled(labels, AVI_SPLIT_LABEL)
+}
+
+// parseSplit reads the ratio and priority of a service from its labels.
+func parseSplit(labels map[string]string, owner string) trafficSplit {
+	split := trafficSplit{Ratio: MIN_SPLIT_RATIO, Priority: labels[AVI_SPLIT_PRIORITY_LABEL]}
+	if val, ok := labels[AVI_SPLIT_RATIO_LABEL]; ok {
+		ratio, err := strconv.Atoi(val)
+		if err != nil || ratio < MIN_SPLIT_RATIO || ratio > MAX_SPLIT_RATIO {
+			log.Warnf("Invalid %s label %s on service %s, using %d", AVI_SPLIT_RATIO_LABEL, val,
+				owner, MIN_SPLIT_RATIO)
+		} else {
+			split.Ratio = ratio
+		}
+	}
+	return split
+}
+
+// addSplit adds the members of a service sharing the VS.
+func (dt *Vservice) addSplit(owner string, labels map[string]string, pools []pool) {
+	if dt.splits == nil {
+		dt.splits = make(map[string]trafficSplit)
+	}
+	dt.splits[owner] = parseSplit(labels, owner)
+	for _, pl := range pools {
+		pl.group = owner
+		dt.pools = append(dt.pools, pl)
+	}
+}
+
+// splitChecksum is the part of the checksum covering the traffic split.
+func splitChecksum(splits map[string]trafficSplit) string {
+	owners := []string{}
+	for owner := range splits {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	sum := ""
+	for _, owner := range owners {
+		sum += fmt.Sprintf("%s:%d:%s;", owner, splits[owner].Ratio, splits[owner].Priority)
+	}
+	return sum
+}
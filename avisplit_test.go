@@ -0,0 +1,136 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func TestParseSplit(t *testing.T) {
+	for _, tc := range []struct {
+		labels map[string]string
+		want   trafficSplit
+	}{
+		{map[string]string{}, trafficSplit{Ratio: 1}},
+		{map[string]string{AVI_SPLIT_RATIO_LABEL: "1"}, trafficSplit{Ratio: 1}},
+		{map[string]string{AVI_SPLIT_RATIO_LABEL: "9"}, trafficSplit{Ratio: 9}},
+		{map[string]string{AVI_SPLIT_RATIO_LABEL: "1000"}, trafficSplit{Ratio: 1000}},
+		{map[string]string{AVI_SPLIT_RATIO_LABEL: "1001"}, trafficSplit{Ratio: 1}},
+		{map[string]string{AVI_SPLIT_RATIO_LABEL: "0"}, trafficSplit{Ratio: 1}},
+		{map[string]string{AVI_SPLIT_RATIO_LABEL: "-5"}, trafficSplit{Ratio: 1}},
+		{map[string]string{AVI_SPLIT_RATIO_LABEL: "half"}, trafficSplit{Ratio: 1}},
+		{map[string]string{AVI_SPLIT_RATIO_LABEL: "3", AVI_SPLIT_PRIORITY_LABEL: "10"}, trafficSplit{Ratio: 3, Priority: "10"}},
+	} {
+		if got := parseSplit(tc.labels, "shop/web"); got != tc.want {
+			t.Errorf("%v: got %+v, want %+v", tc.labels, got, tc.want)
+		}
+	}
+}
+
+func TestSplitChecksum(t *testing.T) {
+	a := &Vservice{}
+	a.addSplit("shop/web-v1", map[string]string{AVI_SPLIT_RATIO_LABEL: "9"}, nil)
+	a.addSplit("shop/web-v2", map[string]string{AVI_SPLIT_RATIO_LABEL: "1"}, nil)
+	b := &Vservice{}
+	b.addSplit("shop/web-v2", map[string]string{AVI_SPLIT_RATIO_LABEL: "1"}, nil)
+	b.addSplit("shop/web-v1", map[string]string{AVI_SPLIT_RATIO_LABEL: "9"}, nil)
+	if splitChecksum(a.splits) != splitChecksum(b.splits) {
+		t.Errorf("checksum depends on the order services were added: %s, %s",
+			splitChecksum(a.splits), splitChecksum(b.splits))
+	}
+	b.addSplit("shop/web-v1", map[string]string{AVI_SPLIT_RATIO_LABEL: "5"}, nil)
+	if splitChecksum(a.splits) == splitChecksum(b.splits) {
+		t.Errorf("checksum does not change with the ratio")
+	}
+}
+
+// fakeMetadata serves services from a Rancher metadata snapshot.
+type fakeMetadata struct {
+	metadata.Client
+	services []metadata.Service
+}
+
+func (m *fakeMetadata) GetVersion() (string, error) {
+	return "1", nil
+}
+
+func (m *fakeMetadata) GetSelfStack() (metadata.Stack, error) {
+	return metadata.Stack{Name: "avi", EnvironmentName: "Default"}, nil
+}
+
+func (m *fakeMetadata) GetServices() ([]metadata.Service, error) {
+	return m.services, nil
+}
+
+func (m *fakeMetadata) GetHosts() ([]metadata.Host, error) {
+	return nil, nil
+}
+
+// sharedService is an external service naming the VS web.
+func sharedService(name string, ip string, split bool) metadata.Service {
+	labels := map[string]string{
+		AVI_PROXY_LABEL:          `{"virtualservice": {"name": "web"}}`,
+		AVI_EXTERNAL_PORTS_LABEL: "80",
+	}
+	if split {
+		labels[AVI_SPLIT_LABEL] = "true"
+	}
+	return metadata.Service{
+		Name:        name,
+		StackName:   "shop",
+		Kind:        SERVICE_KIND_EXTERNAL,
+		Labels:      labels,
+		ExternalIps: []string{ip},
+	}
+}
+
+func TestSplitServices(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		services  []metadata.Service
+		splits    []string
+		conflicts []string
+	}{
+		{"split services share", []metadata.Service{
+			sharedService("web-v1", "10.0.0.1", true),
+			sharedService("web-v2", "10.0.0.2", true),
+		}, []string{"shop/web-v1", "shop/web-v2"}, nil},
+		{"non-split after split collides", []metadata.Service{
+			sharedService("web-v1", "10.0.0.1", true),
+			sharedService("web-v2", "10.0.0.2", true),
+			sharedService("legacy", "10.0.0.3", false),
+		}, []string{"shop/web-v1", "shop/web-v2"}, []string{"shop/legacy"}},
+		{"split after non-split collides", []metadata.Service{
+			sharedService("legacy", "10.0.0.3", false),
+			sharedService("web-v1", "10.0.0.1", true),
+		}, nil, []string{"shop/web-v1"}},
+	} {
+		m := &fakeMetadata{services: tc.services}
+		services, err := GetMetadataServiceConfigs(m, testConfig(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		vs := services["web"]
+		if len(services) != 1 || vs == nil {
+			t.Fatalf("%s: got VSes %v, want only web", tc.name, services)
+		}
+		var splits []string
+		for owner := range vs.splits {
+			splits = append(splits, owner)
+		}
+		sort.Strings(splits)
+		if !reflect.DeepEqual(splits, tc.splits) {
+			t.Errorf("%s: splits %v, want %v", tc.name, splits, tc.splits)
+		}
+		if !reflect.DeepEqual(vs.conflicts, tc.conflicts) {
+			t.Errorf("%s: conflicts %v, want %v", tc.name, vs.conflicts, tc.conflicts)
+		}
+		for _, pl := range vs.pools {
+			if _, ok := vs.splits[pl.group]; len(vs.splits) > 0 && !ok {
+				t.Errorf("%s: member %s outside the split services", tc.name, pl.hostip)
+			}
+		}
+	}
+}
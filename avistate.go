@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+const (
+	// below this many VSes any shrink is plausible
+	minStateSizeForShrinkCheck = 3
+)
+
+type poolState struct {
+	Protocol string      `json:"protocol"`
+	HostIP   string      `json:"host_ip"`
+	PoolName string      `json:"pool_name"`
+	Ports    map[int]int `json:"ports"`
+	Enabled  bool        `json:"enabled"`
+	Zone     string      `json:"zone,omitempty"`
+	Group    string      `json:"group,omitempty"`
+	Ratio    int         `json:"ratio,omitempty"`
+}
+
+type vserviceState struct {
+	ServiceName string                  `json:"service_name"`
+	Labels      map[string]string       `json:"labels"`
+	Pools       []poolState             `json:"pools"`
+	Owner       string                  `json:"owner"`
+	Conflicts   []string                `json:"conflicts,omitempty"`
+	Names       nameData                `json:"names"`
+	LegacyName  string                  `json:"legacy_name,omitempty"`
+	BackendMode string                  `json:"backend_mode"`
+	VipType     string                  `json:"vip_type"`
+	HealthCheck *healthCheck            `json:"health_check,omitempty"`
+	LocalZone   string                  `json:"local_zone,omitempty"`
+	Splits      map[string]trafficSplit `json:"splits,omitempty"`
+}
+
+func toState(dt *Vservice) vserviceState {
+	st := vserviceState{
+		ServiceName: dt.serviceName,
+		Labels:      dt.labels,
+		Owner:       dt.owner,
+		Conflicts:   dt.conflicts,
+		Names:       dt.names,
+		LegacyName:  dt.legacyName,
+		BackendMode: dt.backendMode,
+		VipType:     dt.vipType,
+		HealthCheck: dt.healthCheck,
+		LocalZone:   dt.localZone,
+		Splits:      dt.splits,
+	}
+	for _, pl := range dt.pools {
+		st.Pools = append(st.Pools, poolState{
+			Protocol: pl.protocol,
+			HostIP:   pl.hostip,
+			PoolName: pl.poolName,
+			Ports:    pl.ports,
+			Enabled:  pl.enabled,
+			Zone:     pl.zone,
+			Group:    pl.group,
+			Ratio:    pl.ratio,
+		})
+	}
+	return st
+}
+
+func fromState(st vserviceState) *Vservice {
+	dt := &Vservice{
+		serviceName: st.ServiceName,
+		labels:      st.Labels,
+		owner:       st.Owner,
+		conflicts:   st.Conflicts,
+		names:       st.Names,
+		legacyName:  st.LegacyName,
+		backendMode: st.BackendMode,
+		vipType:     st.VipType,
+		healthCheck: st.HealthCheck,
+		localZone:   st.LocalZone,
+		splits:      st.Splits,
+	}
+	for _, ps := range st.Pools {
+		dt.pools = append(dt.pools, pool{
+			protocol: ps.Protocol,
+			hostip:   ps.HostIP,
+			poolName: ps.PoolName,
+			ports:    ps.Ports,
+			enabled:  ps.Enabled,
+			zone:     ps.Zone,
+			group:    ps.Group,
+			ratio:    ps.Ratio,
+		})
+	}
+	return dt
+}
+
+// copyState returns a copy of the desired state which is not affected by
+// later changes to tasks, such as draining members being added.
+func copyState(tasks map[string]*Vservice) map[string]*Vservice {
+	copied := make(map[string]*Vservice)
+	for name, dt := range tasks {
+		copied[name] = fromState(toState(dt))
+	}
+	return copied
+}
+
+// stateStore keeps the last desired state which was fully reconciled,
+// on disk so that it survives restarts.
+type stateStore struct {
+	sync.Mutex
+	path      string
+	threshold int // percent of the last good state a fresh one must reach
+	lastGood  map[string]*Vservice
+	blocked   []string // VSes of the last state refused
+	accepted  []string // VSes of the state an operator accepted
+}
+
+// stateNames returns the sorted VS names of a desired state.
+func stateNames(tasks map[string]*Vservice) []string {
+	names := []string{}
+	for name := range tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewStateStore loads the last good state from path, if there is one.
+func NewStateStore(cfg *AviConfig) *stateStore {
+	s := &stateStore{path: cfg.stateFile, threshold: cfg.shrinkThreshold}
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		log.Infof("No saved state at %s", s.path)
+		return s
+	} else if err != nil {
+		log.Errorf("Error reading saved state %s: %v", s.path, err)
+		return s
+	}
+
+	var states map[string]vserviceState
+	if err := json.Unmarshal(b, &states); err != nil {
+		log.Errorf("Invalid saved state %s: %v", s.path, err)
+		return s
+	}
+	s.lastGood = make(map[string]*Vservice)
+	for name, st := range states {
+		s.lastGood[name] = fromState(st)
+	}
+	log.Infof("Loaded last good state with %d VSes from %s", len(s.lastGood), s.path)
+	return s
+}
+
+// Plausible returns false if the fresh desired state is so much smaller
+// than the last good one that it is more likely a bad metadata read than
+// services going away, unless an operator accepted a state with the same
+// VSes.
+func (s *stateStore) Plausible(fresh map[string]*Vservice) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	last := len(s.lastGood)
+	if s.threshold == 0 || last < minStateSizeForShrinkCheck {
+		return true
+	}
+	if len(fresh)*100 >= last*s.threshold {
+		return true
+	}
+	names := stateNames(fresh)
+	if s.accepted != nil && reflect.DeepEqual(names, s.accepted) {
+		log.Infof("Operator accepted shrink of desired state from %d to %d VSes", last, len(fresh))
+		s.blocked = nil
+		s.accepted = nil
+		return true
+	}
+	log.Errorf("Desired state shrank from %d to %d VSes, refusing changes until accepted",
+		last, len(fresh))
+	s.blocked = names
+	return false
+}
+
+// Save records tasks as the last good state.
+func (s *stateStore) Save(tasks map[string]*Vservice) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.lastGood = tasks
+	states := make(map[string]vserviceState)
+	for name, dt := range tasks {
+		states[name] = toState(dt)
+	}
+	b, err := json.MarshalIndent(states, "", " ")
+	if err != nil {
+		log.Errorf("Error encoding state: %v", err)
+		return
+	}
+	if err := writeFileAtomic(s.path, b); err != nil {
+		log.Errorf("Error saving state to %s: %v", s.path, err)
+	}
+}
+
+// Accept lets the state last refused go ahead if the next cycle yields
+// the same VSes, and returns them. It returns nil if no state was refused.
+func (s *stateStore) Accept() []string {
+	s.Lock()
+	defer s.Unlock()
+	s.accepted = s.blocked
+	return s.accepted
+}
+
+func adminAcceptState(w http.ResponseWriter, req *http.Request) {
+	accepted := p.state.Accept()
+	if accepted == nil {
+		http.Error(w, "No desired state is refused", http.StatusConflict)
+		return
+	}
+	log.Infof("Operator accepted the desired state of %v", accepted)
+	b, _ := json.MarshalIndent(map[string]interface{}{"accepted": accepted}, "", " ")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
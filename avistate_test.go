@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func desiredState(n int) map[string]*Vservice {
+	tasks := make(map[string]*Vservice)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("vs-%d", i)
+		tasks[name] = &Vservice{serviceName: name}
+	}
+	return tasks
+}
+
+func TestStateStoreAccept(t *testing.T) {
+	s := &stateStore{threshold: 50, lastGood: desiredState(10)}
+	if !s.Plausible(desiredState(6)) {
+		t.Fatalf("shrink to 60%% refused")
+	}
+	if accepted := s.Accept(); accepted != nil {
+		t.Errorf("accepted %v with no state refused", accepted)
+	}
+	if s.Plausible(desiredState(2)) {
+		t.Fatalf("shrink to 20%% not refused")
+	}
+	if accepted := s.Accept(); len(accepted) != 2 {
+		t.Errorf("accepted %v, want the 2 VSes refused", accepted)
+	}
+	// acceptance covers only the state refused
+	if s.Plausible(desiredState(1)) {
+		t.Errorf("different state plausible after accepting")
+	}
+	s.Accept()
+	if !s.Plausible(desiredState(1)) {
+		t.Errorf("accepted state refused")
+	}
+	// and only once
+	if s.Plausible(desiredState(1)) {
+		t.Errorf("acceptance used twice")
+	}
+}
+
+func TestCopyStateWithoutDraining(t *testing.T) {
+	member := pool{hostip: "10.0.0.1", ports: map[int]int{8080: 80}, enabled: true}
+	tasks := map[string]*Vservice{"web": {serviceName: "web", pools: []pool{member}}}
+	desired := copyState(tasks)
+
+	gone := pool{hostip: "10.0.0.2", ports: map[int]int{8080: 80}}
+	d := &drainer{
+		period:   time.Minute,
+		last:     make(map[string]map[string]pool),
+		draining: map[string]map[string]*drainingMember{"web": {memberKey(gone): {member: gone, since: time.Now()}}},
+	}
+	d.Apply(tasks, nil)
+	if len(tasks["web"].pools) != 2 {
+		t.Fatalf("draining member not added: %+v", tasks["web"].pools)
+	}
+	if pools := desired["web"].pools; len(pools) != 1 || pools[0].hostip != "10.0.0.1" {
+		t.Errorf("saved state has members %+v, want only the source's", pools)
+	}
+}
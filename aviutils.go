@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"net/url"
 //	"strconv"
 	"strings"
@@ -159,13 +160,36 @@ func SvcNameFromRnchrPoolName(pName string) string {
 }
 
 func VsFromCloud(vs map[string]interface{}, cloudRef string) bool {
-	vsCloudRef, ok := vs["cloud_ref"]
-	if ok && vsCloudRef.(string) == cloudRef {
-		// VS not part of this cloud
-		return true
+	// refs may or may not carry the host and the cloud's name
+	vsCloud := refUuid(vs["cloud_ref"])
+	return vsCloud != "" && vsCloud == refUuid(cloudRef)
+}
+
+// ipAddrType returns the Avi address type of an IP address.
+func ipAddrType(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip != nil && ip.To4() == nil {
+		return "V6"
 	}
+	return "V4"
+}
 
-	return false
+// isAnyAddr returns true for addresses binding all interfaces.
+func isAnyAddr(addr string) bool {
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.IsUnspecified()
+}
+
+// labelEnabled returns true if the label is set to anything other than
+// empty, "no" or "false".
+func labelEnabled(labels map[string]string, key string) bool {
+	val, ok := labels[key]
+	return ok && val != "" && val != "no" && val != "false"
+}
+
+// VsOwned returns true if the VS was created, or adopted, by Rancher.
+func VsOwned(vs map[string]interface{}) bool {
+	return vs["created_by"] == CREATED_BY
 }
 
 func VsHasMetadata(vs map[string]interface{}, metadata string) bool {
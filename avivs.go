@@ -121,7 +121,7 @@ func (p *Avi) UpdatePoolMembers(pool map[string]interface{},
 		for _, dt := range allTasks {
 			server := make(map[string]interface{})
 			ip := make(map[string]interface{})
-			ip["type"] = "V4"
+			ip["type"] = ipAddrType(dt.ipAddr)
 			ip["addr"] = dt.ipAddr
 			server["ip"] = ip
 			server["port"] = dt.publicPort
@@ -199,7 +199,7 @@ func (p *Avi) AddPoolMembers(pool map[string]interface{}, addedTasks dockerTasks
 	for _, dt := range addedTasks {
 		server := make(map[string]interface{})
 		ip := make(map[string]interface{})
-		ip["type"] = "V4"
+		ip["type"] = ipAddrType(dt.ipAddr)
 		ip["addr"] = dt.ipAddr
 		server["ip"] = ip
 		server["port"] = dt.publicPort
@@ -287,28 +287,51 @@ func (p *Avi) GetPoolGroup(pg string) (map[string]interface{}, error) {
 	return nres.(map[string]interface{}), nil
 }
 
+// GetAllVses returns the VSes created by Rancher in the provider's cloud.
 func (p *Avi) GetAllVses() ([]map[string]interface{}, error) {
 	allVses := make([]map[string]interface{}, 0)
-	res, err := p.aviSession.GetCollection("/api/virtualservice?created_by=Rancher")
+	vses, err := p.GetAllObjects("virtualservice", "created_by="+CREATED_BY)
 	if err != nil {
-		log.Infof("Get all VSes failed: %v", res)
 		return allVses, err
 	}
-
-	if res.Count == 0 {
-		return allVses, nil
+	for _, vs := range vses {
+		if VsFromCloud(vs, p.cloudRef) {
+			allVses = append(allVses, vs)
+		}
 	}
+	return allVses, nil
+}
 
-	for i := 0; i < res.Count; i++ {
-		nres, err := ConvertAviResponseToMapInterface(res.Results[i])
+// GetAllObjects returns every object of the given resource type, following
+// the collection pages. query is appended to the collection URL if set.
+func (p *Avi) GetAllObjects(resource string, query string) ([]map[string]interface{}, error) {
+	allObjs := make([]map[string]interface{}, 0)
+	for page := 1; ; page++ {
+		uri := fmt.Sprintf("/api/%s?page=%d", resource, page)
+		if query != "" {
+			uri = uri + "&" + query
+		}
+		res, err := p.aviSession.GetCollection(uri)
 		if err != nil {
-			log.Infof("VS unmarshal failed: %v", string(res.Results[i]))
-		} else {
-			allVses = append(allVses, nres.(map[string]interface{}))
+			log.Infof("Get all %s failed: %v", resource, err)
+			return allObjs, err
+		}
+
+		for _, r := range res.Results {
+			nres, err := ConvertAviResponseToMapInterface(r)
+			if err != nil {
+				log.Infof("%s unmarshal failed: %v", resource, string(r))
+			} else {
+				allObjs = append(allObjs, nres.(map[string]interface{}))
+			}
+		}
+
+		if res.Next == "" || len(res.Results) == 0 {
+			break
 		}
 	}
 
-	return allVses, nil
+	return allObjs, nil
 }
 
 func (p *Avi) CreatePool(poolName string) (map[string]interface{}, error) {
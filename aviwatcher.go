@@ -0,0 +1,71 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	// a burst of changes never holds back a reconcile for longer than
+	// this many debounce periods
+	maxDebouncePeriods = 10
+)
+
+// changeWatcher turns change notifications from a service source into
+// reconciles. Bursts of changes, like a service scaling up, are coalesced
+// into a single reconcile, and a full resync runs periodically regardless.
+type changeWatcher struct {
+	debounce time.Duration
+	resync   time.Duration
+	changes  chan string
+}
+
+func NewChangeWatcher(cfg *AviConfig) *changeWatcher {
+	return &changeWatcher{
+		debounce: time.Duration(cfg.changeDebounce) * time.Millisecond,
+		resync:   time.Duration(cfg.resyncInterval) * time.Second,
+		changes:  make(chan string, 1),
+	}
+}
+
+// Notify signals a change. It never blocks.
+func (w *changeWatcher) Notify(change string) {
+	select {
+	case w.changes <- change:
+	default:
+		// a reconcile is already pending
+	}
+}
+
+// Run calls reconcile once at start, after every debounced change, and
+// on every resync interval. It never returns.
+func (w *changeWatcher) Run(reconcile func()) {
+	resync := time.NewTicker(w.resync)
+	defer resync.Stop()
+
+	var debounce *time.Timer
+	var debounceC <-chan time.Time
+	var firstChange time.Time
+
+	reconcile()
+	for {
+		select {
+		case change := <-w.changes:
+			log.Infof("Change detected: %s", change)
+			if debounce == nil {
+				firstChange = time.Now()
+				debounce = time.NewTimer(w.debounce)
+				debounceC = debounce.C
+			} else if time.Since(firstChange) < maxDebouncePeriods*w.debounce {
+				debounce.Stop()
+				debounce.Reset(w.debounce)
+			}
+		case <-debounceC:
+			debounce = nil
+			debounceC = nil
+			reconcile()
+		case <-resync.C:
+			log.Info("Periodic full resync")
+			reconcile()
+		}
+	}
+}
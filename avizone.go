@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+const (
+	// pool group members with the higher priority label get the traffic
+	// while any of their servers is up
+	ZONE_PRIORITY_LOCAL  = "2"
+	ZONE_PRIORITY_REMOTE = "1"
+)
+
+// zonePool is the pool of the members of one service sharing the VS, if
+// any, in one zone.
+type zonePool struct {
+	group   string
+	zone    string
+	members []pool
+}
+
+// names returns the name data of the pool.
+func (zp zonePool) names(task *Vservice) nameData {
+	names := task.names
+	names.Zone = zp.zone
+	names.Group = zp.group
+	return names
+}
+
+// zonePools groups the members of the task by service and zone, ordered
+// by service and zone name. Without zones and services sharing the VS
+// this is a single pool of all members.
+func zonePools(task *Vservice) []zonePool {
+	type poolKey struct{ group, zone string }
+	byKey := make(map[poolKey][]pool)
+	for _, pl := range task.pools {
+		key := poolKey{pl.group, pl.zone}
+		byKey[key] = append(byKey[key], pl)
+	}
+	keys := []poolKey{}
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].group != keys[j].group {
+			return keys[i].group < keys[j].group
+		}
+		return keys[i].zone < keys[j].zone
+	})
+	zps := []zonePool{}
+	for _, key := range keys {
+		zps = append(zps, zonePool{group: key.group, zone: key.zone, members: byKey[key]})
+	}
+	if len(zps) == 0 {
+		zps = append(zps, zonePool{})
+	}
+	return zps
+}
+
+// zonePriority returns the priority label of the pool of a zone: the
+// local zone first, every other zone taking over if it fails.
+func zonePriority(task *Vservice, zone string) string {
+	if task.localZone != "" && zone == task.localZone {
+		return ZONE_PRIORITY_LOCAL
+	}
+	return ZONE_PRIORITY_REMOTE
+}
+
+// ownedPoolUuid returns the uuid of the pool of that name if Rancher owns
+// it, else "".
+func (p *Avi) ownedPoolUuid(name string) string {
+	res, err := p.aviSession.GetCollection("/api/pool?name=" + name)
+	if err != nil || res.Count == 0 {
+		return ""
+	}
+	var pool map[string]interface{}
+	if err := json.Unmarshal(res.Results[0], &pool); err != nil {
+		return ""
+	}
+	if pool["created_by"] != CREATED_BY {
+		log.Warnf("Pool %s exists and is not owned by Rancher", name)
+		return ""
+	}
+	uuid, _ := pool["uuid"].(string)
+	return uuid
+}
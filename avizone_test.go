@@ -0,0 +1,80 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestZonePools(t *testing.T) {
+	member := func(ip string, group string, zone string) pool {
+		return pool{hostip: ip, group: group, zone: zone}
+	}
+	for _, tc := range []struct {
+		name  string
+		pools []pool
+		want  []zonePool
+	}{
+		{"no members", nil, []zonePool{{}}},
+		{"no zones", []pool{member("10.0.0.1", "", ""), member("10.0.0.2", "", "")}, []zonePool{
+			{members: []pool{member("10.0.0.1", "", ""), member("10.0.0.2", "", "")}},
+		}},
+		{"zones in order", []pool{member("10.0.0.1", "", "b"), member("10.0.0.2", "", "a"), member("10.0.0.3", "", "b")}, []zonePool{
+			{zone: "a", members: []pool{member("10.0.0.2", "", "a")}},
+			{zone: "b", members: []pool{member("10.0.0.1", "", "b"), member("10.0.0.3", "", "b")}},
+		}},
+		{"services before zones", []pool{member("10.0.0.1", "web", "b"), member("10.0.0.2", "api", "b"), member("10.0.0.3", "web", "a")}, []zonePool{
+			{group: "api", zone: "b", members: []pool{member("10.0.0.2", "api", "b")}},
+			{group: "web", zone: "a", members: []pool{member("10.0.0.3", "web", "a")}},
+			{group: "web", zone: "b", members: []pool{member("10.0.0.1", "web", "b")}},
+		}},
+	} {
+		if got := zonePools(&Vservice{pools: tc.pools}); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestZonePriority(t *testing.T) {
+	for _, tc := range []struct {
+		local string
+		zone  string
+		want  string
+	}{
+		{"", "", ZONE_PRIORITY_REMOTE},
+		{"", "a", ZONE_PRIORITY_REMOTE},
+		{"a", "a", ZONE_PRIORITY_LOCAL},
+		{"a", "b", ZONE_PRIORITY_REMOTE},
+		{"a", "", ZONE_PRIORITY_REMOTE},
+	} {
+		if got := zonePriority(&Vservice{localZone: tc.local}, tc.zone); got != tc.want {
+			t.Errorf("local zone %q, zone %q: priority %s, want %s", tc.local, tc.zone, got, tc.want)
+		}
+	}
+}
+
+func TestZonePoolName(t *testing.T) {
+	task := &Vservice{names: nameData{Environment: "Default", Stack: "shop", Service: "web", VS: "Default-shop-web"}}
+	namer := testConfig(t).namer
+	for _, tc := range []struct {
+		zp   zonePool
+		want string
+	}{
+		{zonePool{zone: "eu-1"}, "Default-shop-web-pool-eu-1"},
+		{zonePool{group: "shop/api"}, "Default-shop-web-pool-shop-api"},
+		{zonePool{group: "shop/api", zone: "eu-1"}, "Default-shop-web-pool-shop-api-eu-1"},
+	} {
+		if got := namer.ZonePoolName(tc.zp.names(task)); got != tc.want {
+			t.Errorf("%+v: pool %s, want %s", tc.zp, got, tc.want)
+		}
+	}
+
+	custom, err := NewAviNamer(DEFAULT_VS_NAME_TEMPLATE, DEFAULT_POOL_NAME_TEMPLATE,
+		"{{.Stack}}.{{.Service}}.{{.Zone}}", DEFAULT_POOLGROUP_NAME_TEMPLATE, DEFAULT_VSVIP_NAME_TEMPLATE,
+		DEFAULT_FQDN_TEMPLATE, DEFAULT_NAME_MAX_LENGTH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := custom.ZonePoolName(zonePool{zone: "eu-1"}.names(task)); got != "shop.web.eu-1" {
+		t.Errorf("custom template pool %s, want shop.web.eu-1", got)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+const (
+	DEFAULT_DOCKER_SOCKET = "/var/run/docker.sock"
+
+	// containers of the same compose service make up one service
+	COMPOSE_PROJECT_LABEL = "com.docker.compose.project"
+	COMPOSE_SERVICE_LABEL = "com.docker.compose.service"
+
+	// wait before reconnecting to the events stream, in seconds
+	dockerRetryInterval = 5
+)
+
+type dockerPort struct {
+	IP          string `json:"IP"`
+	PrivatePort int    `json:"PrivatePort"`
+	PublicPort  int    `json:"PublicPort"`
+	Type        string `json:"Type"`
+}
+
+type dockerNetwork struct {
+	IPAddress string `json:"IPAddress"`
+}
+
+type dockerContainer struct {
+	ID              string            `json:"Id"`
+	Names           []string          `json:"Names"`
+	State           string            `json:"State"`
+	Status          string            `json:"Status"`
+	Labels          map[string]string `json:"Labels"`
+	Ports           []dockerPort      `json:"Ports"`
+	NetworkSettings struct {
+		Networks map[string]dockerNetwork `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+type dockerEvent struct {
+	Action string `json:"Action"`
+	Actor  struct {
+		ID string `json:"ID"`
+	} `json:"Actor"`
+}
+
+func (c dockerContainer) name() string {
+	if len(c.Names) == 0 {
+		return c.ID
+	}
+	return strings.TrimPrefix(c.Names[0], "/")
+}
+
+// healthState maps the health shown in the container status, like
+// "Up 2 minutes (unhealthy)", to Rancher's health states.
+func (c dockerContainer) healthState() string {
+	switch {
+	case strings.Contains(c.Status, "(unhealthy)"):
+		return "unhealthy"
+	case strings.Contains(c.Status, "(health: starting)"):
+		return "initializing"
+	case strings.Contains(c.Status, "(healthy)"):
+		return "healthy"
+	}
+	return ""
+}
+
+// ip returns the container's address on the first of its networks, by
+// network name.
+func (c dockerContainer) ip() string {
+	networks := []string{}
+	for name := range c.NetworkSettings.Networks {
+		networks = append(networks, name)
+	}
+	sort.Strings(networks)
+	for _, name := range networks {
+		if ip := c.NetworkSettings.Networks[name].IPAddress; ip != "" {
+			return ip
+		}
+	}
+	return ""
+}
+
+// service returns the stack and service of the container: the compose
+// project and service if set, else no stack and the container name.
+func (c dockerContainer) service() (string, string) {
+	if svc, ok := c.Labels[COMPOSE_SERVICE_LABEL]; ok && svc != "" {
+		return c.Labels[COMPOSE_PROJECT_LABEL], svc
+	}
+	return "", c.name()
+}
+
+// dockerSource reads containers from the Docker Engine API of a
+// standalone host.
+type dockerSource struct {
+	socket string
+	client *http.Client
+	stream *http.Client
+	cfg    *AviConfig
+}
+
+func NewDockerSource(cfg *AviConfig) (*dockerSource, error) {
+	dial := func(network, addr string) (net.Conn, error) {
+		return net.Dial("unix", cfg.dockerSocket)
+	}
+	s := &dockerSource{
+		socket: cfg.dockerSocket,
+		client: &http.Client{Transport: &http.Transport{Dial: dial}, Timeout: 30 * time.Second},
+		stream: &http.Client{Transport: &http.Transport{Dial: dial}},
+		cfg:    cfg,
+	}
+	if cfg.dockerHostIP == "" {
+		log.Warnf("AVI_DOCKER_HOST_IP not set, ports published on all interfaces will be skipped")
+	}
+	return s, s.HealthCheck()
+}
+
+func (s *dockerSource) Name() string {
+	return SOURCE_DOCKER
+}
+
+func (s *dockerSource) get(path string, result interface{}) error {
+	resp, err := s.client.Get("http://docker" + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Docker API %s returned %s", path, resp.Status)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (s *dockerSource) Services() (map[string]*Vservice, error) {
+	Vservices := make(map[string]*Vservice)
+	var containers []dockerContainer
+	if err := s.get("/containers/json", &containers); err != nil {
+		return Vservices, fmt.Errorf("Error listing containers: %v", err)
+	}
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].name() < containers[j].name()
+	})
+
+	// group containers by service, keeping the order
+	services := [][]dockerContainer{}
+	index := make(map[string]int)
+	for _, c := range containers {
+		stack, svc := c.service()
+		key := stack + "/" + svc
+		if i, ok := index[key]; ok {
+			services[i] = append(services[i], c)
+			continue
+		}
+		index[key] = len(services)
+		services = append(services, []dockerContainer{c})
+	}
+
+	for _, service := range services {
+		stack, svcName := service[0].service()
+		labels := make(map[string]string)
+		for label, val := range service[0].Labels {
+			labels[label] = val
+		}
+		// the agent's own compose project is unknown here, so no stack
+		// is excluded as its own
+		scope := metadata.Service{Name: svcName, StackName: stack, Kind: "service"}
+		if !s.cfg.filter.Allows(scope, "") {
+			continue
+		}
+		if !serviceDiscovered(labels, s.cfg) {
+			continue
+		}
+		healthPolicy := labels[AVI_HEALTH_POLICY_LABEL]
+		backendMode := labelBackendMode(labels, s.cfg.backendMode, stack+"/"+svcName)
+		names := nameData{
+			Environment: s.cfg.environment,
+			Stack:       stack,
+			Service:     svcName,
+			Subdomain:   s.cfg.dnsSubDomain,
+		}
+		serviceName := labelVSName(labels)
+		if serviceName == "" {
+			serviceName = s.cfg.namer.VSName(names)
+		}
+		names.VS = serviceName
+
+		pools := []pool{}
+		addMember := func(ip string, port int, contport int, proto string, enabled bool, ratio int) {
+			if memberExists(Vservices, serviceName, ip, port) {
+				return
+			}
+			poolmem := pool{}
+			poolmem.hostip = ip
+			poolmem.ports = map[int]int{port: contport}
+			poolmem.protocol = proto
+			poolmem.enabled = enabled
+			poolmem.ratio = ratio
+			poolnames := names
+			poolnames.Port = port
+			poolnames.Protocol = proto
+			poolmem.poolName = s.cfg.namer.PoolName(poolnames)
+			pools = append(pools, poolmem)
+		}
+
+		for _, c := range service {
+			state := metadata.Container{
+				Name:        c.name(),
+				UUID:        c.ID,
+				State:       c.State,
+				HealthState: c.healthState(),
+			}
+			enabled, member := memberState(state, healthPolicy)
+			memberStates.Observe(state, enabled, member)
+			if !member {
+				continue
+			}
+			ratio := serverRatio(c.name(), c.Labels)
+			if backendMode == BACKEND_MODE_CONTAINER {
+				ip := c.ip()
+				if ip == "" {
+					log.Warnf("No IP address known for container %s", c.name())
+					continue
+				}
+				cports := []containerPort{}
+				for _, port := range c.Ports {
+					cports = append(cports, containerPort{port.PrivatePort, port.Type})
+				}
+				cports = append(cports, parseContainerPorts(c.name(), labels[AVI_CONTAINER_PORTS_LABEL])...)
+				for _, cp := range cports {
+					addMember(ip, cp.port, cp.port, cp.protocol, enabled, ratio)
+				}
+				continue
+			}
+			for _, port := range c.Ports {
+				if port.PublicPort == 0 {
+					// not published
+					continue
+				}
+				ip := port.IP
+				if ip == "" || isAnyAddr(ip) {
+					ip = s.cfg.dockerHostIP
+					if ip == "" {
+						continue
+					}
+				}
+				addMember(ip, port.PublicPort, port.PrivatePort, port.Type, enabled, ratio)
+			}
+		}
+		if len(pools) == 0 {
+			continue
+		}
+
+		owner := fmt.Sprintf("%s/%s", stack, svcName)
+		if existing, ok := Vservices[serviceName]; ok {
+			log.Errorf("Services %s and %s both claim VS %s", existing.owner, owner, serviceName)
+			existing.conflicts = append(existing.conflicts, owner)
+			continue
+		}
+		dt := Vservice{}
+		dt.serviceName = serviceName
+		dt.labels = labels
+		dt.pools = pools
+		dt.owner = owner
+		dt.names = names
+		dt.backendMode = backendMode
+		dt.vipType = labelVipType(labels, s.cfg.vipType, owner)
+		Vservices[dt.serviceName] = &dt
+	}
+	memberStates.Prune()
+	return Vservices, nil
+}
+
+// Watch follows the events stream for containers starting and stopping,
+// reconnecting after errors.
+func (s *dockerSource) Watch(notify func(change string)) {
+	filters := `{"type":["container"],"event":["start","stop","die","health_status"]}`
+	path := "http://docker/events?filters=" + url.QueryEscape(filters)
+	for {
+		resp, err := s.stream.Get(path)
+		if err != nil {
+			log.Errorf("Error watching Docker events: %v", err)
+			time.Sleep(dockerRetryInterval * time.Second)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			log.Errorf("Docker events returned %s", resp.Status)
+		} else {
+			dec := json.NewDecoder(resp.Body)
+			for {
+				var ev dockerEvent
+				if err := dec.Decode(&ev); err != nil {
+					log.Errorf("Error reading Docker events: %v", err)
+					break
+				}
+				notify(fmt.Sprintf("container %.12s %s", ev.Actor.ID, ev.Action))
+			}
+		}
+		resp.Body.Close()
+		time.Sleep(dockerRetryInterval * time.Second)
+	}
+}
+
+func (s *dockerSource) HealthCheck() error {
+	if err := s.get("/_ping", nil); err != nil {
+		return fmt.Errorf("Docker Engine at %s not reachable: %v", s.socket, err)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// fakeDocker serves the containers on a Docker Engine API socket.
+func fakeDocker(t *testing.T, containers []dockerContainer) string {
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_ping", func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	mux.HandleFunc("/containers/json", func(w http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(w).Encode(containers)
+	})
+	srv := httptest.NewUnstartedServer(mux)
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return socket
+}
+
+func TestDockerSourcePlainContainer(t *testing.T) {
+	containers := []dockerContainer{{
+		ID:     "0123456789abcdef",
+		Names:  []string{"/web"},
+		State:  "running",
+		Status: "Up 2 minutes",
+		Labels: map[string]string{},
+		Ports:  []dockerPort{{IP: "0.0.0.0", PrivatePort: 80, PublicPort: 8080, Type: "tcp"}},
+	}, {
+		ID:     "fedcba9876543210",
+		Names:  []string{"/shop_app_1"},
+		State:  "running",
+		Status: "Up 2 minutes (healthy)",
+		Labels: map[string]string{
+			COMPOSE_PROJECT_LABEL: "shop",
+			COMPOSE_SERVICE_LABEL: "app",
+		},
+		Ports: []dockerPort{{IP: "10.0.0.5", PrivatePort: 80, PublicPort: 8081, Type: "tcp"}},
+	}}
+	cfg := testConfig(t)
+	cfg.dockerSocket = fakeDocker(t, containers)
+	cfg.dockerHostIP = "10.0.0.1"
+	cfg.environment = SOURCE_DOCKER
+	s, err := NewDockerSource(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, err := s.Services()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a plain docker run container is a service without a stack
+	vs, ok := services["docker-web"]
+	if !ok {
+		t.Fatalf("no VS for the plain container in %v", services)
+	}
+	if vs.owner != "/web" {
+		t.Errorf("owner = %s, want /web", vs.owner)
+	}
+	if len(vs.pools) != 1 {
+		t.Fatalf("got pools %+v, want one member", vs.pools)
+	}
+	mem := vs.pools[0]
+	if mem.hostip != "10.0.0.1" || mem.ports[8080] != 80 || !mem.enabled {
+		t.Errorf("member = %+v, want 10.0.0.1:8080 to port 80", mem)
+	}
+
+	vs, ok = services["docker-shop-app"]
+	if !ok {
+		t.Fatalf("no VS for the compose service in %v", services)
+	}
+	if mem := vs.pools[0]; mem.hostip != "10.0.0.5" || mem.ports[8081] != 80 {
+		t.Errorf("member = %+v, want 10.0.0.5:8081 to port 80", mem)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// how often the file is checked for changes, in seconds
+	filePollInterval = 5
+)
+
+// fileMember is one pool server of a static service.
+type fileMember struct {
+	IP            string `yaml:"ip"`
+	Port          int    `yaml:"port"`
+	ContainerPort int    `yaml:"container_port"` // defaults to port
+	Protocol      string `yaml:"protocol"`       // defaults to tcp
+	Enabled       *bool  `yaml:"enabled"`        // defaults to true
+	Ratio         int    `yaml:"ratio"`          // defaults to Avi's default
+}
+
+// fileService is a service in the static file. Labels work like Rancher
+// service labels, so avi_proxy and friends apply.
+type fileService struct {
+	Name        string            `yaml:"name"`
+	Stack       string            `yaml:"stack"`
+	Labels      map[string]string `yaml:"labels"`
+	BackendMode string            `yaml:"backend_mode"`
+	VipType     string            `yaml:"vip_type"`
+	Members     []fileMember      `yaml:"members"`
+}
+
+type fileServices struct {
+	Services []fileService `yaml:"services"`
+}
+
+// fileSource reads services from a YAML or JSON file, for workloads
+// outside Rancher and for testing without a metadata server.
+type fileSource struct {
+	path string
+	cfg  *AviConfig
+}
+
+func NewFileSource(cfg *AviConfig) (*fileSource, error) {
+	if cfg.sourceFile == "" {
+		return nil, fmt.Errorf("AVI_SOURCE_FILE not set")
+	}
+	return &fileSource{path: cfg.sourceFile, cfg: cfg}, nil
+}
+
+func (s *fileSource) Name() string {
+	return SOURCE_FILE
+}
+
+func (s *fileSource) Services() (map[string]*Vservice, error) {
+	Vservices := make(map[string]*Vservice)
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return Vservices, err
+	}
+	// YAML is a superset of JSON, so this reads both
+	var fs fileServices
+	if err := yaml.Unmarshal(b, &fs); err != nil {
+		return Vservices, fmt.Errorf("Invalid service file %s: %v", s.path, err)
+	}
+
+	for _, svc := range fs.Services {
+		if svc.Name == "" {
+			log.Warnf("Skipping service without a name in %s", s.path)
+			continue
+		}
+		scope := metadata.Service{Name: svc.Name, StackName: svc.Stack, Kind: "service"}
+		if !s.cfg.filter.Allows(scope, "") {
+			continue
+		}
+		labels := svc.Labels
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		if !serviceDiscovered(labels, s.cfg) {
+			continue
+		}
+		names := nameData{
+			Environment: s.cfg.environment,
+			Stack:       svc.Stack,
+			Service:     svc.Name,
+			Subdomain:   s.cfg.dnsSubDomain,
+		}
+		serviceName := labelVSName(labels)
+		if serviceName == "" {
+			serviceName = s.cfg.namer.VSName(names)
+		}
+		names.VS = serviceName
+
+		pools := []pool{}
+		for _, mem := range svc.Members {
+			if mem.IP == "" || mem.Port == 0 {
+				log.Warnf("Skipping member without ip or port of service %s", svc.Name)
+				continue
+			}
+			poolmem := pool{}
+			poolmem.hostip = mem.IP
+			contport := mem.ContainerPort
+			if contport == 0 {
+				contport = mem.Port
+			}
+			poolmem.ports = map[int]int{mem.Port: contport}
+			poolmem.protocol = mem.Protocol
+			if poolmem.protocol == "" {
+				poolmem.protocol = "tcp"
+			}
+			poolmem.enabled = mem.Enabled == nil || *mem.Enabled
+			if mem.Ratio < 0 || mem.Ratio > MAX_SERVER_RATIO {
+				log.Warnf("Invalid ratio %d of member %s of service %s", mem.Ratio, mem.IP, svc.Name)
+			} else {
+				poolmem.ratio = mem.Ratio
+			}
+			poolnames := names
+			poolnames.Port = mem.Port
+			poolnames.Protocol = poolmem.protocol
+			poolmem.poolName = s.cfg.namer.PoolName(poolnames)
+			pools = append(pools, poolmem)
+		}
+		if len(pools) == 0 {
+			continue
+		}
+
+		owner := fmt.Sprintf("%s/%s", svc.Stack, svc.Name)
+		if existing, ok := Vservices[serviceName]; ok {
+			log.Errorf("Services %s and %s both claim VS %s", existing.owner, owner, serviceName)
+			existing.conflicts = append(existing.conflicts, owner)
+			continue
+		}
+		dt := Vservice{}
+		dt.serviceName = serviceName
+		dt.labels = labels
+		dt.pools = pools
+		dt.owner = owner
+		dt.names = names
+		dt.backendMode = labelBackendMode(labels, s.cfg.backendMode, owner)
+		if svc.BackendMode != "" {
+			if validBackendMode(svc.BackendMode) {
+				dt.backendMode = svc.BackendMode
+			} else {
+				log.Warnf("Invalid backend_mode %s of service %s, using %s", svc.BackendMode, owner, dt.backendMode)
+			}
+		}
+		dt.vipType = labelVipType(labels, s.cfg.vipType, owner)
+		if svc.VipType != "" {
+			if validVipType(svc.VipType) {
+				dt.vipType = svc.VipType
+			} else {
+				log.Warnf("Invalid vip_type %s of service %s, using %s", svc.VipType, owner, dt.vipType)
+			}
+		}
+		Vservices[dt.serviceName] = &dt
+	}
+	return Vservices, nil
+}
+
+// Watch checks the file's modification time for changes.
+func (s *fileSource) Watch(notify func(change string)) {
+	var last time.Time
+	for {
+		fi, err := os.Stat(s.path)
+		if err != nil {
+			log.Errorf("Error watching %s: %v", s.path, err)
+		} else if !fi.ModTime().Equal(last) {
+			last = fi.ModTime()
+			notify("file " + s.path + " modified")
+		}
+		time.Sleep(filePollInterval * time.Second)
+	}
+}
+
+func (s *fileSource) HealthCheck() error {
+	_, err := os.Stat(s.path)
+	return err
+}
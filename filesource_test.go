@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSourceVSName(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.yaml")
+	err := ioutil.WriteFile(path, []byte(`
+services:
+  - name: web
+    stack: shop
+    members:
+      - ip: 10.0.0.11
+        port: 8080
+  - name: api
+    stack: shop
+    labels:
+      avi_proxy: '{"virtualservice": {"name": "shop-api"}}'
+    members:
+      - ip: 10.0.0.12
+        port: 9090
+  - name: web
+    members:
+      - ip: 10.0.0.13
+        port: 8081
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(t)
+	cfg.sourceFile = path
+	cfg.environment = SOURCE_FILE
+	s, err := NewFileSource(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, err := s.Services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, pool := range map[string]string{
+		"file-shop-web": "file-shop-web-pool-8080-tcp",
+		"shop-api":      "shop-api-pool-9090-tcp",
+		"file-web":      "file-web-pool-8081-tcp",
+	} {
+		vs, ok := services[name]
+		if !ok {
+			t.Errorf("no VS %s in %v", name, services)
+			continue
+		}
+		if vs.serviceName != name || vs.names.VS != name {
+			t.Errorf("VS %s named %s, names %+v", name, vs.serviceName, vs.names)
+		}
+		if vs.pools[0].poolName != pool {
+			t.Errorf("VS %s: pool %s, want %s", name, vs.pools[0].poolName, pool)
+		}
+	}
+}
+
+func TestFileSourceFilter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "services.yaml")
+	err := ioutil.WriteFile(path, []byte(`
+services:
+  - name: web
+    stack: shop
+    members:
+      - ip: 10.0.0.11
+        port: 8080
+  - name: admin
+    stack: shop
+    members:
+      - ip: 10.0.0.12
+        port: 8080
+  - name: web
+    stack: staging
+    members:
+      - ip: 10.0.0.13
+        port: 8080
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(t)
+	cfg.sourceFile = path
+	cfg.environment = SOURCE_FILE
+	if cfg.filter.excludeStacks, err = parseNameFilter("staging"); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.filter.excludeServices, err = parseNameFilter("admin"); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewFileSource(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, err := s.Services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 || services["file-shop-web"] == nil {
+		t.Errorf("got VSes %v, want only file-shop-web", services)
+	}
+}
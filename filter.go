@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+const (
+	// infrastructure stacks Rancher deploys into every environment
+	DEFAULT_EXCLUDE_STACKS = "ipsec,healthcheck,network-services,scheduler,network-policy-manager"
+)
+
+// namePattern is a glob, or a regex when written as /regex/.
+type namePattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+type nameFilter []namePattern
+
+// parseNameFilter parses a comma separated list of globs and /regexes/.
+func parseNameFilter(spec string) (nameFilter, error) {
+	filter := nameFilter{}
+	for _, pattern := range strings.Split(spec, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+			re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+			if err != nil {
+				return filter, fmt.Errorf("Invalid filter regex %s: %v", pattern, err)
+			}
+			filter = append(filter, namePattern{re: re})
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return filter, fmt.Errorf("Invalid filter glob %s: %v", pattern, err)
+		}
+		filter = append(filter, namePattern{glob: pattern})
+	}
+	return filter, nil
+}
+
+func (f nameFilter) Matches(name string) bool {
+	for _, p := range f {
+		if p.re != nil {
+			if p.re.MatchString(name) {
+				return true
+			}
+		} else if ok, _ := path.Match(p.glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceFilter scopes the agent to a subset of stacks, services and
+// service kinds. An empty include list includes everything; excludes win
+// over includes.
+type serviceFilter struct {
+	includeStacks   nameFilter
+	excludeStacks   nameFilter
+	includeServices nameFilter
+	excludeServices nameFilter
+	includeKinds    nameFilter
+	excludeKinds    nameFilter
+	excludeSystem   bool
+}
+
+func included(include nameFilter, exclude nameFilter, name string) bool {
+	if len(include) > 0 && !include.Matches(name) {
+		return false
+	}
+	return !exclude.Matches(name)
+}
+
+// Allows returns true if the service is in scope. selfStack is the stack
+// running this agent, which is never in scope, or "" if the agent runs
+// outside any stack.
+func (f *serviceFilter) Allows(service metadata.Service, selfStack string) bool {
+	if selfStack != "" && service.StackName == selfStack {
+		return false
+	}
+	if f.excludeSystem && service.System {
+		return false
+	}
+	return included(f.includeStacks, f.excludeStacks, service.StackName) &&
+		included(f.includeServices, f.excludeServices, service.Name) &&
+		included(f.includeKinds, f.excludeKinds, service.Kind)
+}
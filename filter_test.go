@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func TestParseNameFilter(t *testing.T) {
+	for _, tc := range []struct {
+		spec    string
+		name    string
+		matches bool
+	}{
+		{"", "web", false},
+		{"web", "web", true},
+		{"web", "web-v2", false},
+		{"web*", "web-v2", true},
+		{"web-?", "web-1", true},
+		{"web-[12]", "web-3", false},
+		{"api, web*", "web-v2", true},
+		{" api ,, db ", "db", true},
+		{"/^web-v[0-9]+$/", "web-v12", true},
+		{"/^web-v[0-9]+$/", "web-vx", false},
+		{"/internal/", "shop-internal-api", true},
+		{"/", "/", true},
+	} {
+		filter, err := parseNameFilter(tc.spec)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", tc.spec, err)
+			continue
+		}
+		if matches := filter.Matches(tc.name); matches != tc.matches {
+			t.Errorf("%q on %s: matches %v, want %v", tc.spec, tc.name, matches, tc.matches)
+		}
+	}
+}
+
+func TestParseNameFilterErrors(t *testing.T) {
+	for _, spec := range []string{"web[", "/web(/", "api,/[/"} {
+		if got, err := parseNameFilter(spec); err == nil {
+			t.Errorf("%q: expected an error, got %v", spec, got)
+		}
+	}
+}
+
+func TestServiceFilterAllows(t *testing.T) {
+	mustParse := func(spec string) nameFilter {
+		filter, err := parseNameFilter(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return filter
+	}
+	web := metadata.Service{Name: "web", StackName: "shop", Kind: "service"}
+	for _, tc := range []struct {
+		name      string
+		filter    serviceFilter
+		service   metadata.Service
+		selfStack string
+		allowed   bool
+	}{
+		{"no filters", serviceFilter{}, web, "avi", true},
+		{"own stack", serviceFilter{}, web, "shop", false},
+		{"outside any stack", serviceFilter{}, web, "", true},
+		{"no stack outside any stack", serviceFilter{}, metadata.Service{Name: "web", Kind: "service"}, "", true},
+		{"system stack", serviceFilter{excludeSystem: true}, metadata.Service{Name: "dns", StackName: "kube-system", System: true}, "", false},
+		{"system stack kept", serviceFilter{}, metadata.Service{Name: "dns", StackName: "kube-system", System: true}, "", true},
+		{"stack included", serviceFilter{includeStacks: mustParse("shop")}, web, "", true},
+		{"stack not included", serviceFilter{includeStacks: mustParse("blog")}, web, "", false},
+		{"stack excluded", serviceFilter{excludeStacks: mustParse("sh*")}, web, "", false},
+		{"exclude wins over include", serviceFilter{includeStacks: mustParse("shop"), excludeStacks: mustParse("/^sh/")}, web, "", false},
+		{"service included", serviceFilter{includeServices: mustParse("web,api")}, web, "", true},
+		{"service excluded", serviceFilter{includeServices: mustParse("*"), excludeServices: mustParse("web")}, web, "", false},
+		{"kind included", serviceFilter{includeKinds: mustParse("service")}, web, "", true},
+		{"kind not included", serviceFilter{includeKinds: mustParse(SERVICE_KIND_EXTERNAL)}, web, "", false},
+		{"kind excluded", serviceFilter{excludeKinds: mustParse("service")}, web, "", false},
+	} {
+		if allowed := tc.filter.Allows(tc.service, tc.selfStack); allowed != tc.allowed {
+			t.Errorf("%s: allowed %v, want %v", tc.name, allowed, tc.allowed)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testConfig returns the configuration of a source with default settings.
+func testConfig(t *testing.T) *AviConfig {
+	namer, err := NewAviNamer(DEFAULT_VS_NAME_TEMPLATE, DEFAULT_POOL_NAME_TEMPLATE,
+		DEFAULT_ZONE_POOL_NAME_TEMPLATE, DEFAULT_POOLGROUP_NAME_TEMPLATE, DEFAULT_VSVIP_NAME_TEMPLATE, DEFAULT_FQDN_TEMPLATE,
+		DEFAULT_NAME_MAX_LENGTH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &AviConfig{
+		namer:         namer,
+		backendMode:   BACKEND_MODE_HOSTPORT,
+		vipType:       VIP_TYPE_V4,
+		discoveryMode: DISCOVERY_OPT_OUT,
+		filter:        new(serviceFilter),
+	}
+}
+
+// aviRequest is a request made to the fake controller.
+type aviRequest struct {
+	method string
+	path   string
+	query  string
+	body   map[string]interface{}
+}
+
+// fakeAvi returns a session to a controller which answers every request
+// with handler's response, and the requests it has seen.
+func fakeAvi(t *testing.T, handler func(req aviRequest) interface{}) (*AviSession, *[]aviRequest) {
+	reqs := []aviRequest{}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := aviRequest{method: r.Method, path: r.URL.Path, query: r.URL.RawQuery}
+		json.NewDecoder(r.Body).Decode(&req.body)
+		reqs = append(reqs, req)
+		json.NewEncoder(w).Encode(handler(req))
+	}))
+	t.Cleanup(srv.Close)
+	return NewAviSession(strings.TrimPrefix(srv.URL, "https://"), "admin", "", true, "admin"), &reqs
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// wait before restarting a closed or failed watch, in seconds
+	kubeRetryInterval = 5
+)
+
+// kubeSource reads Services of type LoadBalancer or NodePort from
+// Kubernetes. Annotations of a Service play the role of Rancher service
+// labels, so an avi_proxy annotation works like the avi_proxy label.
+type kubeSource struct {
+	client    kubernetes.Interface
+	namespace string
+	cfg       *AviConfig
+}
+
+// NewKubeSource connects with AVI_KUBE_CONFIG, or from inside the
+// cluster if it is not set.
+func NewKubeSource(cfg *AviConfig) (*kubeSource, error) {
+	restConfig, err := clientcmd.BuildConfigFromFlags("", cfg.kubeConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load Kubernetes client config: %v", err)
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create Kubernetes client: %v", err)
+	}
+	return newKubeSource(client, cfg), nil
+}
+
+func newKubeSource(client kubernetes.Interface, cfg *AviConfig) *kubeSource {
+	return &kubeSource{client: client, namespace: cfg.kubeNamespace, cfg: cfg}
+}
+
+func (s *kubeSource) Name() string {
+	return SOURCE_KUBERNETES
+}
+
+// kubeLabels merges the labels and annotations of a Service, annotations
+// winning.
+func kubeLabels(meta metav1.ObjectMeta) map[string]string {
+	labels := make(map[string]string)
+	for label, val := range meta.Labels {
+		labels[label] = val
+	}
+	for annotation, val := range meta.Annotations {
+		labels[annotation] = val
+	}
+	return labels
+}
+
+// nodeReady returns true if the node's Ready condition is true.
+func nodeReady(node v1.Node) bool {
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == v1.NodeReady {
+			return cond.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// nodeAddress returns the IP to reach node ports on: the value of the
+// given node label if set, else the node's internal IP.
+func nodeAddress(node v1.Node, label string) string {
+	if label != "" {
+		if ip, ok := node.Labels[label]; ok && ip != "" {
+			return ip
+		}
+	}
+	for _, addr := range node.Status.Addresses {
+		if addr.Type == v1.NodeInternalIP {
+			return addr.Address
+		}
+	}
+	return ""
+}
+
+// endpointPort returns the port of the Endpoints subset serving the
+// Service port.
+func endpointPort(subset v1.EndpointSubset, port v1.ServicePort) (int, bool) {
+	for _, ep := range subset.Ports {
+		if ep.Name == port.Name && ep.Protocol == port.Protocol {
+			return int(ep.Port), true
+		}
+	}
+	return 0, false
+}
+
+func (s *kubeSource) Services() (map[string]*Vservice, error) {
+	Vservices := make(map[string]*Vservice)
+	ctx := context.Background()
+	services, err := s.client.CoreV1().Services(s.namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return Vservices, fmt.Errorf("Error listing services: %v", err)
+	}
+	nodes, err := s.client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return Vservices, fmt.Errorf("Error listing nodes: %v", err)
+	}
+	sort.Slice(nodes.Items, func(i, j int) bool {
+		return nodes.Items[i].Name < nodes.Items[j].Name
+	})
+
+	for _, service := range services.Items {
+		if service.Spec.Type != v1.ServiceTypeLoadBalancer && service.Spec.Type != v1.ServiceTypeNodePort {
+			continue
+		}
+		// namespaces play the role of stacks, and kube-system that of
+		// Rancher's system stacks
+		scope := metadata.Service{
+			Name:      service.Name,
+			StackName: service.Namespace,
+			Kind:      "service",
+			System:    service.Namespace == metav1.NamespaceSystem,
+		}
+		if !s.cfg.filter.Allows(scope, "") {
+			continue
+		}
+		labels := kubeLabels(service.ObjectMeta)
+		if !serviceDiscovered(labels, s.cfg) {
+			continue
+		}
+		healthPolicy := labels[AVI_HEALTH_POLICY_LABEL]
+		backendMode := labelBackendMode(labels, s.cfg.backendMode, service.Namespace+"/"+service.Name)
+		names := nameData{
+			Environment: s.cfg.environment,
+			Stack:       service.Namespace,
+			Service:     service.Name,
+			Subdomain:   s.cfg.dnsSubDomain,
+		}
+		serviceName := labelVSName(labels)
+		if serviceName == "" {
+			serviceName = s.cfg.namer.VSName(names)
+		}
+		names.VS = serviceName
+
+		pools := []pool{}
+		addMember := func(ip string, port int, targetPort int, proto string, enabled bool) {
+			if memberExists(Vservices, serviceName, ip, port) {
+				return
+			}
+			poolmem := pool{}
+			poolmem.hostip = ip
+			poolmem.ports = map[int]int{port: targetPort}
+			poolmem.protocol = proto
+			poolmem.enabled = enabled
+			poolnames := names
+			poolnames.Port = port
+			poolnames.Protocol = proto
+			poolmem.poolName = s.cfg.namer.PoolName(poolnames)
+			pools = append(pools, poolmem)
+		}
+
+		if backendMode == BACKEND_MODE_CONTAINER {
+			endpoints, err := s.client.CoreV1().Endpoints(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+			if err != nil {
+				log.Warnf("Error reading endpoints of service %s/%s: %v", service.Namespace, service.Name, err)
+				continue
+			}
+			// ready addresses are enabled members, the others are
+			// handled as the health policy says
+			notReadyMember, notReadyEnabled := healthPolicy != HEALTH_POLICY_REMOVE, healthPolicy == HEALTH_POLICY_IGNORE
+			for _, subset := range endpoints.Subsets {
+				for _, port := range service.Spec.Ports {
+					target, ok := endpointPort(subset, port)
+					if !ok {
+						continue
+					}
+					proto := strings.ToLower(string(port.Protocol))
+					for _, addr := range subset.Addresses {
+						addMember(addr.IP, target, target, proto, true)
+					}
+					if !notReadyMember {
+						continue
+					}
+					for _, addr := range subset.NotReadyAddresses {
+						addMember(addr.IP, target, target, proto, notReadyEnabled)
+					}
+				}
+			}
+		} else {
+			for _, port := range service.Spec.Ports {
+				if port.NodePort == 0 {
+					continue
+				}
+				proto := strings.ToLower(string(port.Protocol))
+				target := port.TargetPort.IntValue()
+				if target == 0 {
+					// named target port, differs between pods
+					target = int(port.Port)
+				}
+				for _, node := range nodes.Items {
+					if node.Spec.Unschedulable {
+						continue
+					}
+					ip := nodeAddress(node, s.cfg.hostIPLabel)
+					if ip == "" {
+						log.Warnf("No IP address known for node %s", node.Name)
+						continue
+					}
+					addMember(ip, int(port.NodePort), target, proto, nodeReady(node))
+				}
+			}
+		}
+		if len(pools) == 0 {
+			continue
+		}
+
+		owner := fmt.Sprintf("%s/%s", service.Namespace, service.Name)
+		if existing, ok := Vservices[serviceName]; ok {
+			log.Errorf("Services %s and %s both claim VS %s", existing.owner, owner, serviceName)
+			existing.conflicts = append(existing.conflicts, owner)
+			continue
+		}
+		dt := Vservice{}
+		dt.serviceName = serviceName
+		dt.labels = labels
+		dt.pools = pools
+		dt.owner = owner
+		dt.names = names
+		dt.backendMode = backendMode
+		dt.vipType = labelVipType(labels, s.cfg.vipType, owner)
+		Vservices[dt.serviceName] = &dt
+	}
+	return Vservices, nil
+}
+
+// watchResource runs a watch started by start until it fails or closes,
+// then starts it again.
+func watchResource(resource string, start func() (watch.Interface, error), notify func(change string)) {
+	for {
+		w, err := start()
+		if err != nil {
+			log.Errorf("Error watching %s: %v", resource, err)
+			time.Sleep(kubeRetryInterval * time.Second)
+			continue
+		}
+		for ev := range w.ResultChan() {
+			if ev.Type == watch.Error {
+				log.Errorf("Error watching %s: %v", resource, ev.Object)
+				break
+			}
+			change := fmt.Sprintf("%s %s", resource, strings.ToLower(string(ev.Type)))
+			if meta, ok := ev.Object.(metav1.Object); ok {
+				change = fmt.Sprintf("%s %s/%s %s", resource, meta.GetNamespace(), meta.GetName(),
+					strings.ToLower(string(ev.Type)))
+			}
+			notify(change)
+		}
+		w.Stop()
+		time.Sleep(kubeRetryInterval * time.Second)
+	}
+}
+
+// Watch watches services, endpoints and nodes.
+func (s *kubeSource) Watch(notify func(change string)) {
+	ctx := context.Background()
+	core := s.client.CoreV1()
+	go watchResource("endpoints", func() (watch.Interface, error) {
+		return core.Endpoints(s.namespace).Watch(ctx, metav1.ListOptions{})
+	}, notify)
+	go watchResource("node", func() (watch.Interface, error) {
+		return core.Nodes().Watch(ctx, metav1.ListOptions{})
+	}, notify)
+	watchResource("service", func() (watch.Interface, error) {
+		return core.Services(s.namespace).Watch(ctx, metav1.ListOptions{})
+	}, notify)
+}
+
+func (s *kubeSource) HealthCheck() error {
+	_, err := s.client.Discovery().ServerVersion()
+	return err
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func kubeNode(name string, ip string, ready bool, unschedulable bool) *v1.Node {
+	status := v1.ConditionFalse
+	if ready {
+		status = v1.ConditionTrue
+	}
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       v1.NodeSpec{Unschedulable: unschedulable},
+		Status: v1.NodeStatus{
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: status}},
+			Addresses:  []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: ip}},
+		},
+	}
+}
+
+func kubeService(name string, svcType v1.ServiceType, annotations map[string]string) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "web",
+			Labels:      map[string]string{"tier": "frontend"},
+			Annotations: annotations,
+		},
+		Spec: v1.ServiceSpec{
+			Type: svcType,
+			Ports: []v1.ServicePort{{
+				Name:       "http",
+				Protocol:   v1.ProtocolTCP,
+				Port:       80,
+				TargetPort: intstr.FromInt(8080),
+				NodePort:   30080,
+			}},
+		},
+	}
+}
+
+// members returns the members of the VS by address and port.
+func members(vs *Vservice) map[string]pool {
+	byAddr := make(map[string]pool)
+	for _, pl := range vs.pools {
+		for port := range pl.ports {
+			byAddr[fmt.Sprintf("%s:%d", pl.hostip, port)] = pl
+		}
+	}
+	return byAddr
+}
+
+func TestKubeSourceNodePorts(t *testing.T) {
+	client := fake.NewClientset(
+		kubeNode("node-a", "10.0.0.1", true, false),
+		kubeNode("node-b", "10.0.0.2", false, false),
+		kubeNode("node-c", "10.0.0.3", true, true),
+		kubeService("app", v1.ServiceTypeNodePort, nil),
+		kubeService("internal", v1.ServiceTypeClusterIP, nil),
+	)
+	s := newKubeSource(client, testConfig(t))
+	services, err := s.Services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 {
+		t.Fatalf("got %d VSes, want 1: %v", len(services), services)
+	}
+	vs, ok := services["web-app"]
+	if !ok {
+		t.Fatalf("no VS web-app in %v", services)
+	}
+	if vs.owner != "web/app" {
+		t.Errorf("owner = %s, want web/app", vs.owner)
+	}
+	mems := members(vs)
+	if len(mems) != 2 {
+		t.Fatalf("got members %v, want node-a and node-b", mems)
+	}
+	a, ok := mems["10.0.0.1:30080"]
+	if !ok || !a.enabled || a.protocol != "tcp" || a.ports[30080] != 8080 {
+		t.Errorf("member of ready node-a = %+v", a)
+	}
+	if b := mems["10.0.0.2:30080"]; b.enabled {
+		t.Errorf("member of not ready node-b is enabled")
+	}
+	if a.poolName != "web-app-pool-30080-tcp" {
+		t.Errorf("pool name = %s", a.poolName)
+	}
+}
+
+func TestKubeSourceEndpoints(t *testing.T) {
+	svc := kubeService("app", v1.ServiceTypeLoadBalancer, map[string]string{
+		AVI_BACKEND_MODE_LABEL: BACKEND_MODE_CONTAINER,
+	})
+	endpoints := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "web"},
+		Subsets: []v1.EndpointSubset{{
+			Addresses:         []v1.EndpointAddress{{IP: "172.16.0.1"}},
+			NotReadyAddresses: []v1.EndpointAddress{{IP: "172.16.0.2"}},
+			Ports:             []v1.EndpointPort{{Name: "http", Port: 8080, Protocol: v1.ProtocolTCP}},
+		}},
+	}
+	client := fake.NewClientset(kubeNode("node-a", "10.0.0.1", true, false), svc, endpoints)
+
+	for _, tc := range []struct {
+		policy   string
+		notReady bool // not ready address is a member
+		enabled  bool // and enabled
+	}{
+		{"", true, false},
+		{HEALTH_POLICY_REMOVE, false, false},
+		{HEALTH_POLICY_IGNORE, true, true},
+	} {
+		svc.Annotations[AVI_HEALTH_POLICY_LABEL] = tc.policy
+		if _, err := client.CoreV1().Services("web").Update(context.Background(), svc, metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		services, err := newKubeSource(client, testConfig(t)).Services()
+		if err != nil {
+			t.Fatal(err)
+		}
+		vs := services["web-app"]
+		if vs == nil {
+			t.Fatalf("policy %q: no VS web-app in %v", tc.policy, services)
+		}
+		if vs.backendMode != BACKEND_MODE_CONTAINER {
+			t.Errorf("policy %q: backend mode = %s", tc.policy, vs.backendMode)
+		}
+		mems := members(vs)
+		if ready, ok := mems["172.16.0.1:8080"]; !ok || !ready.enabled {
+			t.Errorf("policy %q: ready address = %+v", tc.policy, ready)
+		}
+		notReady, ok := mems["172.16.0.2:8080"]
+		if ok != tc.notReady || notReady.enabled != tc.enabled {
+			t.Errorf("policy %q: not ready address = %+v, member %v", tc.policy, notReady, ok)
+		}
+	}
+}
+
+func TestKubeSourceLabels(t *testing.T) {
+	proxy := `{"virtualservice": {"name": "shop"}}`
+	client := fake.NewClientset(
+		kubeNode("node-a", "10.0.0.1", true, false),
+		kubeService("app", v1.ServiceTypeNodePort, map[string]string{
+			AVI_PROXY_LABEL: proxy,
+			"tier":          "backend",
+		}),
+		kubeService("skipped", v1.ServiceTypeNodePort, map[string]string{
+			AVI_INTEGRATION_LABEL: "true",
+		}),
+	)
+	services, err := newKubeSource(client, testConfig(t)).Services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 {
+		t.Fatalf("got %d VSes, want 1: %v", len(services), services)
+	}
+	vs, ok := services["shop"]
+	if !ok {
+		t.Fatalf("avi_proxy annotation did not name the VS: %v", services)
+	}
+	if vs.labels[AVI_PROXY_LABEL] != proxy {
+		t.Errorf("annotation missing from labels: %v", vs.labels)
+	}
+	if vs.labels["tier"] != "backend" {
+		t.Errorf("annotation does not win over label: tier = %s", vs.labels["tier"])
+	}
+	if vs.names.VS != "shop" || vs.pools[0].poolName != "shop-pool-30080-tcp" {
+		t.Errorf("names not after the VS: %+v, pool %s", vs.names, vs.pools[0].poolName)
+	}
+}
+
+func TestKubeSourceRemoval(t *testing.T) {
+	client := fake.NewClientset(
+		kubeNode("node-a", "10.0.0.1", true, false),
+		kubeService("app", v1.ServiceTypeNodePort, nil),
+	)
+	s := newKubeSource(client, testConfig(t))
+	services, err := s.Services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 {
+		t.Fatalf("got %d VSes before removal, want 1", len(services))
+	}
+	if err := client.CoreV1().Services("web").Delete(context.Background(), "app", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	services, err = s.Services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 0 {
+		t.Errorf("removed service still has VSes: %v", services)
+	}
+}
+
+func TestKubeSourceFilter(t *testing.T) {
+	system := kubeService("dns", v1.ServiceTypeNodePort, nil)
+	system.Namespace = metav1.NamespaceSystem
+	client := fake.NewClientset(
+		kubeNode("node-a", "10.0.0.1", true, false),
+		kubeService("app", v1.ServiceTypeNodePort, nil),
+		kubeService("admin", v1.ServiceTypeNodePort, nil),
+		system,
+	)
+	cfg := testConfig(t)
+	cfg.filter.excludeSystem = true
+	excludes, err := parseNameFilter("admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.filter.excludeServices = excludes
+	services, err := newKubeSource(client, cfg).Services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 1 || services["web-app"] == nil {
+		t.Errorf("got VSes %v, want only web-app", services)
+	}
+}
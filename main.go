@@ -1,42 +1,46 @@
 package main
 
 import (
-	"time"
-	"github.com/Sirupsen/logrus"
-	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/sirupsen/logrus"
         "github.com/gorilla/mux"
         "net/http"
 	"os"
 )
 
-const (
-	metadataUrl = "http://rancher-metadata/2016-07-29"
-)
-
 var (
         router          = mux.NewRouter()
         healthcheckPort = ":1000"
 	p = new(Avi)
-	m metadata.Client
 )
 var log = logrus.New()
 type Avi struct {
 	aviSession *AviSession
 	cfg        *AviConfig
 	cloudRef   string
+
+	deleteGuard *deleteGuard
+	gcGuard     *deleteGuard
+	collisions  *collisions
+	state       *stateStore
+	source      ServiceSource
+	drainer     *drainer
 }
 
 func startHealthcheck() {
         router.HandleFunc("/", healthcheck).Methods("GET", "HEAD").Name("Healthcheck")
+        router.HandleFunc("/admin/deletions", adminDeletions).Methods("GET").Name("Deletions")
+        router.HandleFunc("/admin/deletions/confirm", adminAuth(p.cfg.adminToken, adminConfirmDeletions)).Methods("POST").Name("ConfirmDeletions")
+        router.HandleFunc("/admin/collisions", adminCollisions).Methods("GET").Name("Collisions")
+        router.HandleFunc("/admin/state/accept", adminAuth(p.cfg.adminToken, adminAcceptState)).Methods("POST").Name("AcceptState")
         log.Info("Healthcheck handler is listening on ", healthcheckPort)
         log.Fatal(http.ListenAndServe(healthcheckPort, router))
 }
 
 func healthcheck(w http.ResponseWriter, req *http.Request) {
-        // 1) test metadata server
-        _, err := m.GetSelfStack()
+        // 1) test service source
+        err := p.source.HealthCheck()
         if err != nil {
-                log.Errorf("Metadata health check failed: %v", err)
+                log.Errorf("%s source health check failed: %v", p.source.Name(), err)
         } else {
                 // 2) test Avi
                 if err := p.HealthCheck(); err != nil {
@@ -50,7 +54,7 @@ func healthcheck(w http.ResponseWriter, req *http.Request) {
 func initLogger() {
 	f, err := os.OpenFile("/var/log/avi-rancher.log", os.O_APPEND | os.O_CREATE | os.O_RDWR, 0666)
 	if err != nil {
-		log.Info("error opening file: %v", err)
+		log.Infof("error opening file: %v", err)
 	}
 	log.Out = f
 }
@@ -74,52 +78,46 @@ func (p *Avi) Init() error {
 	p.cfg = cfg
 	p.aviSession = aviSession
 	p.cloudRef = cloudRef
+	p.deleteGuard = NewDeleteGuard(cfg)
+	p.gcGuard = NewDeleteGuard(cfg)
+	p.collisions = NewCollisions()
+	p.state = NewStateStore(cfg)
 	log.Info("Avi configuration OK")
 
-	// Initialize metadata client
-	log.Info("Initializing Rancher metadata client")
-	m, err = metadata.NewClientAndWait(metadataUrl)
-
+	source, err := NewServiceSource(cfg)
 	if err != nil {
-		log.Fatalf("Failed to initialize Rancher metadata client: %v", err)
+		log.Fatalf("Failed to initialize %s service source: %v", cfg.source, err)
 		return err
 	}
+	p.source = source
 
 	go startHealthcheck()
 
-	version := "init"
-	lastUpdated := time.Now()
-	tasks := make(map[string]*Vservice)
-	for {
-		update := false
-		newVersion, err := m.GetVersion()
-		if err != nil {
-			log.Errorf("Error reading metadata version: %v", err)
-		} else if version != newVersion {
-			log.Infof("Metadata Version has been changed. Old version: %s. New version: %s.", version, newVersion)
-			version = newVersion
-			update = true
-		} else {
-			log.Info("No changes in metadata version")
-			if time.Since(lastUpdated).Seconds() >= 30 {
-				log.Info("No changes in metadata version last 30 seconds")
-				update = true
-			}
-		}
-		if update {
-			tasks, err = GetMetadataServiceConfigs(m, p.cfg)
-			if err != nil {
-				log.Errorf("Failed to get Service configs from metadata: %v", err)
-				continue
-			}
-			parse_docker_tasks(p, tasks)
-			lastUpdated = time.Now()
-		}
-		time.Sleep(5 * time.Second)
-	}
+	w := NewChangeWatcher(cfg)
+	p.drainer = NewDrainer(cfg, w.Notify)
+	go source.Watch(w.Notify)
+	w.Run(p.Reconcile)
 	return nil
 }
 
+// Reconcile brings Avi in line with the services of the source.
+func (p *Avi) Reconcile() {
+	tasks, err := p.source.Services()
+	if err != nil {
+		log.Errorf("Failed to get Service configs from %s source: %v", p.source.Name(), err)
+		return
+	}
+	if !p.state.Plausible(tasks) {
+		return
+	}
+	// the state saved is the source's, without the members still draining
+	desired := copyState(tasks)
+	p.drainer.Apply(tasks, p.OpenConnections)
+	parse_docker_tasks(p, tasks)
+	p.GarbageCollect()
+	p.state.Save(desired)
+}
+
 func (p *Avi) GetName() string {
 	return ProviderName
 }
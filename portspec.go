@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// portBinding is a single published port of a container.
+type portBinding struct {
+	hostIP        string // empty when published on all interfaces
+	hostPort      int
+	containerPort int
+	protocol      string // tcp/udp
+}
+
+// parsePortRange parses "80" or "8000-8010" into the first and last port.
+func parsePortRange(spec string) (int, int, error) {
+	bounds := strings.Split(spec, "-")
+	if len(bounds) > 2 {
+		return 0, 0, fmt.Errorf("invalid port range %s", spec)
+	}
+	first, err := strconv.Atoi(bounds[0])
+	if err != nil || first <= 0 || first > 65535 {
+		return 0, 0, fmt.Errorf("invalid port %s", bounds[0])
+	}
+	if len(bounds) == 1 {
+		return first, first, nil
+	}
+	last, err := strconv.Atoi(bounds[1])
+	if err != nil || last < first || last > 65535 {
+		return 0, 0, fmt.Errorf("invalid port range %s", spec)
+	}
+	return first, last, nil
+}
+
+// parseProtocols parses "tcp", "udp" or both as "tcp+udp".
+func parseProtocols(spec string) ([]string, error) {
+	protos := []string{}
+	for _, proto := range strings.FieldsFunc(strings.ToLower(spec), func(r rune) bool {
+		return r == '+' || r == ','
+	}) {
+		if proto != "tcp" && proto != "udp" {
+			return nil, fmt.Errorf("invalid protocol %s", proto)
+		}
+		protos = append(protos, proto)
+	}
+	if len(protos) == 0 || strings.HasPrefix(spec, "+") || strings.HasSuffix(spec, "+") {
+		return nil, fmt.Errorf("invalid protocol %s", spec)
+	}
+	return protos, nil
+}
+
+// splitHostSpec splits the part before the protocol into host IP, host
+// port and container port. IPv6 host IPs may be bracketed or not.
+func splitHostSpec(spec string) (string, string, string, error) {
+	if strings.HasPrefix(spec, "[") {
+		end := strings.Index(spec, "]:")
+		if end < 0 {
+			return "", "", "", fmt.Errorf("unterminated IPv6 address")
+		}
+		rest := strings.Split(spec[end+2:], ":")
+		if len(rest) != 2 {
+			return "", "", "", fmt.Errorf("expected host and container port")
+		}
+		return spec[1:end], rest[0], rest[1], nil
+	}
+
+	parts := strings.Split(spec, ":")
+	switch len(parts) {
+	case 1:
+		return "", "", parts[0], nil
+	case 2:
+		return "", parts[0], parts[1], nil
+	case 3:
+		return parts[0], parts[1], parts[2], nil
+	}
+	// unbracketed IPv6 address
+	last := strings.LastIndex(spec, ":")
+	prev := strings.LastIndex(spec[:last], ":")
+	if ip := net.ParseIP(spec[:prev]); ip == nil || ip.To4() != nil {
+		return "", "", "", fmt.Errorf("invalid host IP %s", spec[:prev])
+	}
+	return spec[:prev], spec[prev+1 : last], spec[last+1:], nil
+}
+
+// parsePortSpec parses a Docker/Rancher port mapping into one binding per
+// published port and protocol. It accepts
+//
+//	[hostip:]hostport:containerport[/proto]
+//	[ipv6]:hostport:containerport[/proto]
+//	hostport-range:containerport-range[/proto]
+//
+// where proto is tcp, udp or tcp+udp, and tcp if left out. Ports which
+// are exposed but not published on the host are an error.
+func parsePortSpec(spec string) ([]portBinding, error) {
+	bindings := []portBinding{}
+	hostSpec := spec
+	protoSpec := "tcp"
+	if i := strings.LastIndex(spec, "/"); i >= 0 {
+		hostSpec = spec[:i]
+		protoSpec = spec[i+1:]
+	}
+	protos, err := parseProtocols(protoSpec)
+	if err != nil {
+		return bindings, fmt.Errorf("port spec %s: %v", spec, err)
+	}
+
+	hostIP, hostPorts, contPorts, err := splitHostSpec(hostSpec)
+	if err != nil {
+		return bindings, fmt.Errorf("port spec %s: %v", spec, err)
+	}
+	if hostPorts == "" {
+		return bindings, fmt.Errorf("port spec %s: not published on the host", spec)
+	}
+
+	hostFirst, hostLast, err := parsePortRange(hostPorts)
+	if err != nil {
+		return bindings, fmt.Errorf("port spec %s: %v", spec, err)
+	}
+	contFirst, contLast, err := parsePortRange(contPorts)
+	if err != nil {
+		return bindings, fmt.Errorf("port spec %s: %v", spec, err)
+	}
+	if hostLast-hostFirst != contLast-contFirst {
+		return bindings, fmt.Errorf("port spec %s: host and container port ranges differ in size", spec)
+	}
+
+	for i := 0; i <= hostLast-hostFirst; i++ {
+		for _, proto := range protos {
+			bindings = append(bindings, portBinding{
+				hostIP:        hostIP,
+				hostPort:      hostFirst + i,
+				containerPort: contFirst + i,
+				protocol:      proto,
+			})
+		}
+	}
+	return bindings, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePortSpec(t *testing.T) {
+	for _, tc := range []struct {
+		spec string
+		want []portBinding
+	}{
+		{"8080:80/tcp", []portBinding{
+			{"", 8080, 80, "tcp"},
+		}},
+		{"8080:80", []portBinding{
+			{"", 8080, 80, "tcp"},
+		}},
+		{"53:53/UDP", []portBinding{
+			{"", 53, 53, "udp"},
+		}},
+		{"10.0.0.1:8080:80/tcp", []portBinding{
+			{"10.0.0.1", 8080, 80, "tcp"},
+		}},
+		{"0.0.0.0:8080:80", []portBinding{
+			{"0.0.0.0", 8080, 80, "tcp"},
+		}},
+		{"8000-8002:9000-9002/tcp", []portBinding{
+			{"", 8000, 9000, "tcp"},
+			{"", 8001, 9001, "tcp"},
+			{"", 8002, 9002, "tcp"},
+		}},
+		{"53:53/tcp+udp", []portBinding{
+			{"", 53, 53, "tcp"},
+			{"", 53, 53, "udp"},
+		}},
+		{"5000-5001:6000-6001/tcp+udp", []portBinding{
+			{"", 5000, 6000, "tcp"},
+			{"", 5000, 6000, "udp"},
+			{"", 5001, 6001, "tcp"},
+			{"", 5001, 6001, "udp"},
+		}},
+		{"[2001:db8::1]:8080:80/tcp", []portBinding{
+			{"2001:db8::1", 8080, 80, "tcp"},
+		}},
+		{"[::]:8080:80", []portBinding{
+			{"::", 8080, 80, "tcp"},
+		}},
+		{"2001:db8::1:8080:80/udp", []portBinding{
+			{"2001:db8::1", 8080, 80, "udp"},
+		}},
+		{":::8080:80", []portBinding{
+			{"::", 8080, 80, "tcp"},
+		}},
+	} {
+		got, err := parsePortSpec(tc.spec)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.spec, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.spec, got, tc.want)
+		}
+	}
+}
+
+func TestParsePortSpecErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"80",
+		"80/tcp",
+		":80",
+		"8080:80/sctp",
+		"8080:80/",
+		"8080:80/tcp+",
+		"http:80",
+		"8080:http",
+		"0:80",
+		"8080:70000",
+		"8000-8002:9000-9001",
+		"8000-8002:9000",
+		"8002-8000:9002-9000",
+		"8000-8001-8002:9000",
+		"[2001:db8::1:8080:80",
+		"[2001:db8::1]:80",
+		"10.0.0.1:8080:80:90/tcp",
+	} {
+		if got, err := parsePortSpec(spec); err == nil {
+			t.Errorf("%q: expected an error, got %v", spec, got)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	DISCOVERY_OPT_OUT  = "opt-out"
+	DISCOVERY_OPT_IN   = "opt-in"
+	DISCOVERY_SELECTOR = "selector"
+
+	DEFAULT_ENABLE_LABEL = "avi_proxy_enable"
+)
+
+// selectorTerm is one comma separated term of a label selector.
+type selectorTerm struct {
+	key   string
+	value string
+	op    string // "=", "!=", "exists" or "!exists"
+}
+
+type labelSelector []selectorTerm
+
+// parseLabelSelector parses expressions like "tier=frontend,!internal".
+// Terms are key=value, key!=value, key (label set) and !key (label not
+// set), and all of them must match.
+func parseLabelSelector(expr string) (labelSelector, error) {
+	selector := labelSelector{}
+	for _, term := range strings.Split(expr, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		var t selectorTerm
+		if i := strings.Index(term, "!="); i >= 0 {
+			t = selectorTerm{strings.TrimSpace(term[:i]), strings.TrimSpace(term[i+2:]), "!="}
+		} else if i := strings.Index(term, "="); i >= 0 {
+			t = selectorTerm{strings.TrimSpace(term[:i]), strings.TrimSpace(strings.TrimLeft(term[i+1:], "=")), "="}
+		} else if strings.HasPrefix(term, "!") {
+			t = selectorTerm{strings.TrimSpace(term[1:]), "", "!exists"}
+		} else {
+			t = selectorTerm{term, "", "exists"}
+		}
+		if t.key == "" {
+			return selector, fmt.Errorf("Invalid label selector term %s", term)
+		}
+		selector = append(selector, t)
+	}
+	return selector, nil
+}
+
+func (s labelSelector) Matches(labels map[string]string) bool {
+	for _, t := range s {
+		val, ok := labels[t.key]
+		switch t.op {
+		case "=":
+			if !ok || val != t.value {
+				return false
+			}
+		case "!=":
+			if ok && val == t.value {
+				return false
+			}
+		case "exists":
+			if !ok {
+				return false
+			}
+		case "!exists":
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// serviceDiscovered decides from its labels whether a service gets a VS.
+// no_avi_proxy always opts a service out.
+func serviceDiscovered(labels map[string]string, cfg *AviConfig) bool {
+	if _, ok := labels[AVI_INTEGRATION_LABEL]; ok {
+		return false
+	}
+	switch cfg.discoveryMode {
+	case DISCOVERY_OPT_IN:
+		return labelEnabled(labels, cfg.enableLabel)
+	case DISCOVERY_SELECTOR:
+		return cfg.labelSelector.Matches(labels)
+	}
+	return true
+}
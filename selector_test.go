@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLabelSelector(t *testing.T) {
+	for _, tc := range []struct {
+		expr string
+		want labelSelector
+	}{
+		{"", labelSelector{}},
+		{"tier=frontend", labelSelector{{"tier", "frontend", "="}}},
+		{"tier==frontend", labelSelector{{"tier", "frontend", "="}}},
+		{"tier!=backend", labelSelector{{"tier", "backend", "!="}}},
+		{"public", labelSelector{{"public", "", "exists"}}},
+		{"!internal", labelSelector{{"internal", "", "!exists"}}},
+		{"tier=", labelSelector{{"tier", "", "="}}},
+		{" tier = frontend , !internal ,, public ", labelSelector{
+			{"tier", "frontend", "="},
+			{"internal", "", "!exists"},
+			{"public", "", "exists"},
+		}},
+	} {
+		got, err := parseLabelSelector(tc.expr)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", tc.expr, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %v, want %v", tc.expr, got, tc.want)
+		}
+	}
+}
+
+func TestParseLabelSelectorErrors(t *testing.T) {
+	for _, expr := range []string{"=frontend", "!=backend", "==frontend", "!", "tier=frontend, =x"} {
+		if got, err := parseLabelSelector(expr); err == nil {
+			t.Errorf("%q: expected an error, got %v", expr, got)
+		}
+	}
+}
+
+func TestLabelSelectorMatches(t *testing.T) {
+	for _, tc := range []struct {
+		expr    string
+		labels  map[string]string
+		matches bool
+	}{
+		{"", map[string]string{}, true},
+		{"tier=frontend", map[string]string{"tier": "frontend"}, true},
+		{"tier=frontend", map[string]string{"tier": "backend"}, false},
+		{"tier=frontend", map[string]string{}, false},
+		{"tier!=backend", map[string]string{"tier": "frontend"}, true},
+		{"tier!=backend", map[string]string{}, true},
+		{"tier!=backend", map[string]string{"tier": "backend"}, false},
+		{"public", map[string]string{"public": ""}, true},
+		{"public", map[string]string{}, false},
+		{"!internal", map[string]string{}, true},
+		{"!internal", map[string]string{"internal": "false"}, false},
+		{"tier=frontend,!internal", map[string]string{"tier": "frontend"}, true},
+		{"tier=frontend,!internal", map[string]string{"tier": "frontend", "internal": "true"}, false},
+	} {
+		selector, err := parseLabelSelector(tc.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if matches := selector.Matches(tc.labels); matches != tc.matches {
+			t.Errorf("%q on %v: matches %v, want %v", tc.expr, tc.labels, matches, tc.matches)
+		}
+	}
+}
+
+func TestServiceDiscovered(t *testing.T) {
+	selector, err := parseLabelSelector("tier=frontend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		mode       string
+		labels     map[string]string
+		discovered bool
+	}{
+		{DISCOVERY_OPT_OUT, map[string]string{}, true},
+		{DISCOVERY_OPT_OUT, map[string]string{AVI_INTEGRATION_LABEL: "true"}, false},
+		{DISCOVERY_OPT_IN, map[string]string{}, false},
+		{DISCOVERY_OPT_IN, map[string]string{DEFAULT_ENABLE_LABEL: "true"}, true},
+		{DISCOVERY_OPT_IN, map[string]string{DEFAULT_ENABLE_LABEL: "false"}, false},
+		{DISCOVERY_OPT_IN, map[string]string{DEFAULT_ENABLE_LABEL: "true", AVI_INTEGRATION_LABEL: "true"}, false},
+		{DISCOVERY_SELECTOR, map[string]string{"tier": "frontend"}, true},
+		{DISCOVERY_SELECTOR, map[string]string{"tier": "backend"}, false},
+		{DISCOVERY_SELECTOR, map[string]string{"tier": "frontend", AVI_INTEGRATION_LABEL: "true"}, false},
+	} {
+		cfg := &AviConfig{discoveryMode: tc.mode, enableLabel: DEFAULT_ENABLE_LABEL, labelSelector: selector}
+		if discovered := serviceDiscovered(tc.labels, cfg); discovered != tc.discovered {
+			t.Errorf("%s with %v: discovered %v, want %v", tc.mode, tc.labels, discovered, tc.discovered)
+		}
+	}
+}
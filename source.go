@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+const (
+	SOURCE_RANCHER    = "rancher"
+	SOURCE_FILE       = "file"
+	SOURCE_DOCKER     = "docker"
+	SOURCE_KUBERNETES = "kubernetes"
+
+	metadataUrl = "http://rancher-metadata/2016-07-29"
+
+	// long poll timeout for metadata version changes, in seconds
+	metadataPollInterval = 5
+)
+
+// ServiceSource produces the desired set of VSes from some inventory of
+// running services.
+type ServiceSource interface {
+	// Name identifies the source in logs.
+	Name() string
+
+	// Services returns the desired VSes by VS name.
+	Services() (map[string]*Vservice, error)
+
+	// Watch calls notify whenever the services may have changed. It
+	// never returns.
+	Watch(notify func(change string))
+
+	// HealthCheck returns an error if the source can't be read.
+	HealthCheck() error
+}
+
+// NewServiceSource returns the source selected by the config.
+func NewServiceSource(cfg *AviConfig) (ServiceSource, error) {
+	switch cfg.source {
+	case SOURCE_RANCHER:
+		return NewRancherSource(cfg)
+	case SOURCE_FILE:
+		return NewFileSource(cfg)
+	case SOURCE_DOCKER:
+		return NewDockerSource(cfg)
+	case SOURCE_KUBERNETES:
+		return NewKubeSource(cfg)
+	}
+	return nil, fmt.Errorf("Unknown service source %s", cfg.source)
+}
+
+// rancherSource reads services from Rancher metadata.
+type rancherSource struct {
+	m   metadata.Client
+	cfg *AviConfig
+}
+
+func NewRancherSource(cfg *AviConfig) (*rancherSource, error) {
+	log.Info("Initializing Rancher metadata client")
+	m, err := metadata.NewClientAndWait(metadataUrl)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to initialize Rancher metadata client: %v", err)
+	}
+	return &rancherSource{m: m, cfg: cfg}, nil
+}
+
+func (s *rancherSource) Name() string {
+	return SOURCE_RANCHER
+}
+
+func (s *rancherSource) Services() (map[string]*Vservice, error) {
+	return GetMetadataServiceConfigs(s.m, s.cfg)
+}
+
+// Watch long-polls metadata for version changes, restarting the poll
+// after errors.
+func (s *rancherSource) Watch(notify func(change string)) {
+	for {
+		err := s.m.OnChangeWithError(metadataPollInterval, func(version string) {
+			notify("metadata version " + version)
+		})
+		log.Errorf("Error watching metadata version: %v", err)
+		time.Sleep(metadataPollInterval * time.Second)
+	}
+}
+
+func (s *rancherSource) HealthCheck() error {
+	_, err := s.m.GetSelfStack()
+	return err
+}